@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Aggregation rules synthesize new metrics at ingest, with the syntax of
+// carbon-aggregator's aggregation-rules.conf:
+//
+//   <prefix>.total (60) = sum <prefix>.*.count
+//
+// Every received sample matching the input pattern updates the output
+// metric's bucket right away, so derived metrics can be queried like any
+// other. Once an interval is over (plus the aggregation delay), it is
+// finalized: forwarded as a single line when raw lines are forwarded,
+// and samples arriving for it later are ignored.
+
+var aggregationRuleRegex = regexp.MustCompile(`^\s*(\S+)\s+\((\d+)\)\s*=\s*(sum|avg|min|max|count)\s+(\S+)\s*$`)
+var aggregationFieldRegex = regexp.MustCompile(`<<?[^<>]+>>?`)
+
+type AggregationRule struct {
+	Output    string
+	Frequency int64
+	Method    string
+	Input     string
+	regex     *regexp.Regexp
+}
+
+func ParseAggregationRule(line string) (*AggregationRule, error) {
+	m := aggregationRuleRegex.FindStringSubmatch(line)
+	if m == nil {
+		return nil, fmt.Errorf("bad aggregation rule %q, expected output (frequency) = method input", line)
+	}
+	frequency, err := strconv.ParseInt(m[2], 10, 64)
+	if err != nil || frequency <= 0 {
+		return nil, fmt.Errorf("bad aggregation rule %q: bad frequency", line)
+	}
+	rule := &AggregationRule{Output: m[1], Frequency: frequency, Method: m[3], Input: m[4]}
+	rule.regex, err = regexp.Compile(aggregationPatternToRegex(rule.Input))
+	if err != nil {
+		return nil, fmt.Errorf("bad aggregation rule %q: %s", line, err)
+	}
+	return rule, nil
+}
+
+// aggregationPatternToRegex follows carbon's AggregationRule.build_regex:
+// <field> matches a single name component, <<field>> any number of them.
+func aggregationPatternToRegex(pattern string) string {
+	parts := strings.Split(pattern, ".")
+	regex_parts := make([]string, len(parts))
+	for k, part := range parts {
+		i, j := strings.Index(part, "<<"), strings.Index(part, ">>")
+		if i > -1 && j > i {
+			regex_parts[k] = fmt.Sprintf("%s(?P<%s>.+)%s", part[:i], part[i+2:j], part[j+2:])
+			continue
+		}
+		i, j = strings.Index(part, "<"), strings.Index(part, ">")
+		if i > -1 && j > i {
+			regex_parts[k] = fmt.Sprintf("%s(?P<%s>[^.]+)%s", part[:i], part[i+1:j], part[j+1:])
+		} else if part == "*" {
+			regex_parts[k] = "[^.]+"
+		} else {
+			regex_parts[k] = strings.Replace(part, "*", "[^.]*", -1)
+		}
+	}
+	return "^" + strings.Join(regex_parts, `\.`) + "$"
+}
+
+// OutputName returns the name of the derived metric for an input metric,
+// or "" if the rule doesn't apply to it.
+func (self *AggregationRule) OutputName(metric string) string {
+	m := self.regex.FindStringSubmatch(metric)
+	if m == nil {
+		return ""
+	}
+	fields := make(map[string]string)
+	for i, name := range self.regex.SubexpNames() {
+		if name != "" {
+			fields[name] = m[i]
+		}
+	}
+	return aggregationFieldRegex.ReplaceAllStringFunc(self.Output, func(field string) string {
+		return fields[strings.Trim(field, "<>")]
+	})
+}
+
+func LoadAggregationRules(path string) ([]*AggregationRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	rules := make([]*AggregationRule, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := ParseAggregationRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+type aggregationBuffer struct {
+	rule       *AggregationRule
+	intervals  map[int64]*rollupAccumulator
+	open_since int64 // samples for earlier intervals are too late
+}
+
+type Aggregator struct {
+	sync.Mutex
+	rules   []*AggregationRule
+	storage *Storage
+	delay   int64
+	buffers map[string]*aggregationBuffer // by output name
+}
+
+func NewAggregator(rules []*AggregationRule, storage *Storage, precision_seconds int, delay_seconds int) (*Aggregator, error) {
+	for _, rule := range rules {
+		if rule.Frequency%int64(precision_seconds) != 0 {
+			return nil, fmt.Errorf("aggregation frequency of %s must be a multiple of precision (%d)", rule.Output, precision_seconds)
+		}
+	}
+	a := &Aggregator{}
+	a.rules = rules
+	a.storage = storage
+	a.delay = int64(delay_seconds)
+	a.buffers = make(map[string]*aggregationBuffer)
+	return a, nil
+}
+
+// Process feeds a received sample to the rules.
+func (self *Aggregator) Process(metric string, value float64, ts int64) {
+	self.Lock()
+	defer self.Unlock()
+	for _, rule := range self.rules {
+		output := rule.OutputName(metric)
+		if output == "" {
+			continue
+		}
+		buffer, ok := self.buffers[output]
+		if !ok {
+			buffer = &aggregationBuffer{rule: rule, intervals: make(map[int64]*rollupAccumulator)}
+			self.buffers[output] = buffer
+		}
+		interval := ts - ts%rule.Frequency
+		if interval < buffer.open_since {
+			continue
+		}
+		acc, ok := buffer.intervals[interval]
+		if !ok {
+			acc = &rollupAccumulator{}
+			buffer.intervals[interval] = acc
+		}
+		acc.add(value)
+		self.storage.SetMetricValue(output, acc.result(rule.Method), interval)
+	}
+}
+
+// Finalize closes intervals which ended more than `delay` seconds before now
+// and returns Carbon protocol lines with their values.
+func (self *Aggregator) Finalize(now int64) []string {
+	self.Lock()
+	defer self.Unlock()
+	lines := make([]string, 0)
+	for output, buffer := range self.buffers {
+		for interval, acc := range buffer.intervals {
+			end := interval + buffer.rule.Frequency
+			if end+self.delay > now {
+				continue
+			}
+			lines = append(lines, formatCarbonLine(output, acc.result(buffer.rule.Method), interval))
+			delete(buffer.intervals, interval)
+			if end > buffer.open_since {
+				buffer.open_since = end
+			}
+		}
+		if len(buffer.intervals) == 0 && buffer.open_since+int64(self.storage.duration) < now {
+			delete(self.buffers, output)
+		}
+	}
+	return lines
+}
+
+func (self *AlmazServer) AggregationLoop() {
+	for {
+		time.Sleep(time.Second)
+		p := self.pipeline()
+		if p.aggregator == nil {
+			continue
+		}
+		lines := p.aggregator.Finalize(time.Now().Unix())
+		for _, line := range lines {
+			p.forwardLine(line)
+		}
+	}
+}
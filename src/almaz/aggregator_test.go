@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func Test_AggregationRuleMatching(t *testing.T) {
+	rule, err := ParseAggregationRule("<prefix>.total (60) = sum <prefix>.*.count")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, rule.Frequency, 60)
+	AssertEqual(t, rule.Method, "sum")
+	AssertEqual(t, rule.OutputName("shows.web1.count"), "shows.total")
+	AssertEqual(t, rule.OutputName("shows.web1.errors"), "")
+	AssertEqual(t, rule.OutputName("a.shows.web1.count"), "")
+
+	rule, err = ParseAggregationRule("<<path>>.all.<type> (10) = avg <<path>>.host-*.<type>")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, rule.OutputName("a.b.c.host-12.latency"), "a.b.c.all.latency")
+	AssertEqual(t, rule.OutputName("a.b.c.web-12.latency"), "")
+
+	_, err = ParseAggregationRule("a.total = sum a.*")
+	AssertEqual(t, err != nil, true)
+	_, err = ParseAggregationRule("a.total (60) = median a.*")
+	AssertEqual(t, err != nil, true)
+}
+
+func Test_AggregatorUpdatesDerivedMetrics(t *testing.T) {
+	s := NewStorage()
+	s.SetStorageParams(1, 10)
+	rules := make([]*AggregationRule, 0)
+	for _, r := range []string{
+		"<prefix>.total (20) = sum <prefix>.*.count",
+		"<prefix>.max (10) = max <prefix>.*.count",
+	} {
+		rule, err := ParseAggregationRule(r)
+		AssertEqual(t, err, nil)
+		rules = append(rules, rule)
+	}
+	a, err := NewAggregator(rules, s, 10, 5)
+	AssertEqual(t, err, nil)
+
+	a.Process("shows.web1.count", 3, 100)
+	AssertEqual(t, s.metrics["shows.total"].GetValueAt(100), 3)
+	a.Process("shows.web2.count", 4, 115)
+	AssertEqual(t, s.metrics["shows.total"].GetValueAt(100), 7)
+	AssertEqual(t, s.metrics["shows.max"].GetValueAt(100), 3)
+	AssertEqual(t, s.metrics["shows.max"].GetValueAt(110), 4)
+	a.Process("shows.web1.count", 1, 121)
+	AssertEqual(t, s.metrics["shows.total"].GetValueAt(120), 1)
+
+	lines := a.Finalize(124)
+	sort.Strings(lines)
+	AssertEqual(t, lines, []string{"shows.max 3 100"})
+	lines = a.Finalize(126)
+	sort.Strings(lines)
+	AssertEqual(t, lines, []string{"shows.max 4 110", "shows.total 7 100"})
+
+	// too late for a finalized interval
+	a.Process("shows.web3.count", 100, 105)
+	AssertEqual(t, s.metrics["shows.total"].GetValueAt(100), 7)
+
+	_, err = NewAggregator([]*AggregationRule{&AggregationRule{Output: "x", Frequency: 15}}, s, 10, 5)
+	AssertEqual(t, err != nil, true)
+}
+
+func Test_AggregatorFinalizeFormatting(t *testing.T) {
+	s := NewStorage()
+	s.SetStorageParams(1, 10)
+	rule, err := ParseAggregationRule("<prefix>.avg (10) = avg <prefix>.*.rate")
+	AssertEqual(t, err, nil)
+	a, err := NewAggregator([]*AggregationRule{rule}, s, 10, 0)
+	AssertEqual(t, err, nil)
+
+	a.Process("shows.web1.rate", 1, 100)
+	a.Process("shows.web2.rate", 2, 101)
+	a.Process("clicks.web1.rate", 2e-7, 100)
+	a.Process("views.web1.rate", 0.1, 100)
+	lines := a.Finalize(110)
+	sort.Strings(lines)
+	AssertEqual(t, lines, []string{"clicks.avg 2e-07 100", "shows.avg 1.5 100", "views.avg 0.1 100"})
+}
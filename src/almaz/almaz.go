@@ -8,43 +8,130 @@ import (
 )
 
 var (
-	bindAddress      = flag.String("address", ":7701", "address to listen on for metrics (Carbon-compatible protocol)")
-	httpAddress      = flag.String("http-address", ":7702", "address to recieve queries (http)")
-	fwdAddress       = flag.String("fwd-address", "", "address to forward metrics to (Carbon-compatible protocol)")
-	runAudits        = flag.Bool("audit", false, "run audits periodically")
-	persist          = flag.Bool("persist", false, "persist to disk (load at startup, save on SIGTERM/SIGINT) (see --persist-path)")
-	persistPath      = flag.String("persist-path", "almaz.dat", "path to storage file")
-	persistInterval  = flag.Int("bgsave", 0, "save to disk every N seconds (0 --- do not save). Must have --persist specified.")
-	debug            = flag.Bool("debug", false, "print additional info")
-	storageDuration  = flag.Int("duration-in-hours", 24, "store metrics for last N hours")
-	storagePrecision = flag.Int("precision-in-seconds", 60, "store metrics with precision of N seconds")
-	acceptanceRegex  = flag.String("regex", "", "accept only metrics which match regular expression")
-	cpuprofile       = flag.String("cpuprofile", "", "Write cpuprofile info to file")
+	bindAddress         = flag.String("address", ":7701", "address to listen on for metrics (Carbon-compatible protocol)")
+	httpAddress         = flag.String("http-address", ":7702", "address to recieve queries (http)")
+	fwdAddress          = flag.String("fwd-address", "", "comma-separated host:port[:instance] list to forward metrics to (Carbon-compatible protocol)")
+	fwdMode             = flag.String("fwd-mode", RelayModeConsistentHashing, "how to choose forward destinations: consistent-hashing (compatible with carbon-relay) or all")
+	fwdReplication      = flag.Int("fwd-replication", 1, "forward each metric to N destinations (consistent-hashing mode)")
+	fwdRegex            = flag.String("fwd-regex", "", "forward only metrics which match regular expression")
+	fwdQueueSize        = flag.Int("fwd-queue-size", 100000, "max number of lines waiting to be forwarded; lines beyond it are dropped")
+	fwdBatchSize        = flag.Int("fwd-batch-size", 1000, "max number of lines forwarded in a single write")
+	fwdSpoolDir         = flag.String("fwd-spool-dir", "", "spill lines which don't fit into the forwarding queue to this directory")
+	fwdSpoolBytes       = flag.Int64("fwd-spool-max-bytes", 1<<30, "max size of spilled lines per destination, in bytes")
+	fwdRollup           = flag.Bool("fwd-rollup", false, "forward each metric once per bucket, when the bucket closes, instead of raw lines")
+	fwdRollupDelay      = flag.Int("fwd-rollup-delay", 5, "wait N seconds for late arrivals before forwarding a closed bucket")
+	fwdRollupRules      = flag.String("fwd-rollup-rules", "", "file with rules producing summary metrics in rollup mode, e.g. stats.shows.all = sum(stats.shows.*)")
+	aggregationRules    = flag.String("aggregation-rules", "", "file with carbon-aggregator style rules producing new metrics at ingest, e.g. <prefix>.total (60) = sum <prefix>.*.count")
+	aggregationDelay    = flag.Int("aggregation-delay", 5, "accept samples for an aggregation interval until N seconds after it ends")
+	runAudits           = flag.Bool("audit", false, "run audits periodically, pruning idle metrics (see --prune-ttl)")
+	persist             = flag.Bool("persist", false, "persist to disk (load at startup, save on SIGTERM/SIGINT) (see --persist-path)")
+	persistPath         = flag.String("persist-path", "almaz.dat", "path to storage file")
+	persistInterval     = flag.Int("bgsave", 0, "save to disk every N seconds (0 --- do not save). Must have --persist specified.")
+	persistKeep         = flag.Int("persist-keep", 0, "keep last N timestamped snapshots next to --persist-path (0 --- overwrite a single file)")
+	persistCompress     = flag.Bool("persist-compress", false, "compress metrics in the storage file (files are loaded regardless of this setting)")
+	debug               = flag.Bool("debug", false, "print additional info")
+	storageDuration     = flag.Int("duration-in-hours", 24, "store metrics for last N hours")
+	storagePrecision    = flag.Int("precision-in-seconds", 60, "store metrics with precision of N seconds")
+	filterRulesPath     = flag.String("filter-rules", "", "file with allow <regex> and deny <regex> rules deciding which metrics are stored (evaluated before --regex and --deny-regex)")
+	whisperImport       = flag.String("whisper-import", "", "import a tree of Whisper files from directory at startup")
+	whisperExport       = flag.String("whisper-export", "", "export all metrics as a tree of Whisper files into directory and exit")
+	rewriteRules        = flag.String("rewrite-rules", "", "file with rules renaming, copying or dropping metrics at ingest, e.g. rename ^stats_counts\\.(.*)$ stats.$1")
+	cpuprofile          = flag.String("cpuprofile", "", "Write cpuprofile info to file")
+	maxMetrics          = flag.Int("max-metrics", 0, "do not create metrics beyond N (0 --- no limit); samples of new metrics are rejected")
+	maxPerPrefix        = flag.Int("max-metrics-per-prefix", 0, "do not create more than N metrics under a single prefix (see --prefix-depth)")
+	prefixDepth         = flag.Int("prefix-depth", 2, "number of leading name components forming a prefix for --max-metrics-per-prefix")
+	maxNewPerMinute     = flag.Int("max-new-metrics-per-minute", 0, "do not create more than N new metrics per minute")
+	maxMemory           = flag.Int64("max-memory", 0, "evict least recently written or queried metrics when their values take more than N bytes (0 --- no limit)")
+	evictPath           = flag.String("evict-path", "", "save evicted metrics to timestamped files next to this path, in --persist-path format")
+	pruneInterval       = flag.Int("prune-interval", 60, "look for idle metrics every N seconds (see --audit)")
+	pruneTTL            = flag.Int("prune-ttl", 0, "prune metrics which got no samples for N seconds (0 --- for the whole --duration-in-hours)")
+	pruneRules          = flag.String("prune-rules", "", "file with per-pattern idle TTLs overriding --prune-ttl, e.g. ^servers\\.tmp- 3600")
+	selfPrefix          = flag.String("self-prefix", "almaz.<host>.", "store almaz's own metrics under this prefix (empty --- do not store)")
+	prometheusRules     = flag.String("prometheus-rules", "", "file with rules exposing metrics at /metrics, e.g. stats_counts.adv.shows.*.* adv_shows_total site=$1 zone=$2")
+	prometheusWindow    = flag.Int("prometheus-window", 0, "expose sums over last N seconds at /metrics (0 --- values of the last complete bucket)")
+	remoteWriteTemplate = flag.String("remote-write-template", "{__name__}", "name of metrics received with Prometheus remote_write, {label} is replaced with the label value, e.g. prometheus.{job}.{__name__}")
+	influxAddress       = flag.String("influx-address", "", "address to listen on for Influx line protocol (TCP and UDP, TCP only with TLS); it is also accepted at /write of the http interface")
+	influxTemplate      = flag.String("influx-template", "{measurement}.{field}", "name of metrics received as Influx line protocol, {measurement}, {field} and {tag} are replaced with their values")
+	openTSDBAddress     = flag.String("opentsdb-address", "", "additional address to listen on for OpenTSDB put lines (they are also accepted on --address and at /api/put)")
+	openTSDBTags        = flag.String("opentsdb-tags", "", "comma-separated order of OpenTSDB tags folded into names, e.g. host,cpu; other tags follow sorted by name")
+	futureTolerance     = flag.Int("future-tolerance", 600, "reject samples with timestamps more than N seconds ahead of the clock (0 --- no limit)")
+	futurePolicy        = flag.String("future-policy", "reject", "what to do with samples beyond --future-tolerance: reject or clamp (store them at the time of receipt)")
+	tlsCert             = flag.String("tls-cert", "", "certificate file (PEM) for TLS on --address and --http-address")
+	tlsKey              = flag.String("tls-key", "", "private key file (PEM) of --tls-cert")
+	tlsClientCA         = flag.String("tls-client-ca", "", "require client certificates signed by CAs from this file (PEM)")
+	clientPrefixRules   = flag.String("client-prefix-rules", "", "file with prefixes of metrics clients may write, by certificate common name, e.g. tenant-a tenants.a.")
+	configPath          = flag.String("config", "", "JSON file with settings overriding command-line options, keyed by option names; reloaded on SIGHUP")
 )
 
+// filterRuleFlag collects --regex and --deny-regex in the order they are given.
+type filterRuleFlag struct {
+	action string
+	rules  *[]string
+}
+
+func (self *filterRuleFlag) String() string {
+	return ""
+}
+
+func (self *filterRuleFlag) Set(re string) error {
+	*self.rules = append(*self.rules, self.action+" "+re)
+	return nil
+}
+
+var filterRules = make([]string, 0)
+
+func init() {
+	flag.Var(&filterRuleFlag{"allow", &filterRules}, "regex", "accept only metrics which match regular expression (can be repeated)")
+	flag.Var(&filterRuleFlag{"deny", &filterRules}, "deny-regex", "reject metrics which match regular expression (can be repeated)")
+}
+
 func main() {
 	flag.Parse()
-	server := NewAlmazServer(*persistPath)
-	server.storage.SetStorageParams(*storageDuration, *storagePrecision)
-	if *cpuprofile != "" {
-		f, err := os.Create(*cpuprofile)
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("bad config: %s", err)
+	}
+	tls_config, err := LoadTLSConfig(config)
+	if err != nil {
+		log.Fatalf("bad TLS config: %s", err)
+	}
+	server := NewAlmazServer()
+	server.SetConfigPath(*configPath)
+	err = server.ApplyConfig(config)
+	if err != nil {
+		log.Fatalf("bad config: %s", err)
+	}
+	if config.Cpuprofile != "" {
+		f, err := os.Create(config.Cpuprofile)
 		if err != nil {
 			log.Println(err.Error())
 		}
-		log.Printf("Writing cpuprofile to %v\n", *cpuprofile)
+		log.Printf("Writing cpuprofile to %v\n", config.Cpuprofile)
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 	}
-	if *acceptanceRegex != "" {
-		server.AddAcceptanceRegex(*acceptanceRegex)
-	}
-	if *persist {
+	if config.Persist {
 		server.LoadFromDisk()
 	}
-	if *runAudits {
-		go server.AuditLoop()
+	if config.WhisperImport != "" {
+		server.ImportWhisper(config.WhisperImport)
+	}
+	if config.WhisperExport != "" {
+		server.ExportWhisper(config.WhisperExport)
+		return
+	}
+	go server.AuditLoop()
+	go server.RollupLoop()
+	go server.AggregationLoop()
+	go server.MemoryLoop()
+	go server.SelfStatsLoop()
+	go server.StartGraphite(config.Address, tls_config)
+	go server.StartHttpface(config.HttpAddress, tls_config)
+	if config.OpenTSDBAddress != "" {
+		go server.StartGraphite(config.OpenTSDBAddress, tls_config)
+	}
+	if config.InfluxAddress != "" {
+		go server.StartInflux(config.InfluxAddress, tls_config)
 	}
-	go server.StartGraphite(*bindAddress)
-	go server.StartHttpface(*httpAddress)
-	server.WaitForTermination(*persist, *persistInterval)
+	server.WaitForTermination()
 }
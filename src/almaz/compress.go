@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// Gorilla-style XOR compression of float32 rings (see "Gorilla: A Fast,
+// Scalable, In-Memory Time Series Database", section 4.1.2).
+// Timestamps are implicit in the ring, so only values are encoded.
+// A value equal to the previous one (most notably a run of zeros)
+// costs a single bit.
+
+var ErrCorruptPackedArray = errors.New("corrupt packed array")
+
+type bitWriter struct {
+	buf   []byte
+	nbits uint
+}
+
+func (self *bitWriter) writeBit(bit bool) {
+	if self.nbits%8 == 0 {
+		self.buf = append(self.buf, 0)
+	}
+	if bit {
+		self.buf[len(self.buf)-1] |= 1 << (7 - self.nbits%8)
+	}
+	self.nbits++
+}
+
+func (self *bitWriter) writeBits(value uint64, n uint) {
+	for n > 0 {
+		n--
+		self.writeBit((value>>n)&1 == 1)
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	pos uint
+}
+
+func (self *bitReader) readBit() (bool, error) {
+	if self.pos/8 >= uint(len(self.buf)) {
+		return false, ErrCorruptPackedArray
+	}
+	bit := (self.buf[self.pos/8]>>(7-self.pos%8))&1 == 1
+	self.pos++
+	return bit, nil
+}
+
+func (self *bitReader) readBits(n uint) (uint64, error) {
+	var value uint64
+	for ; n > 0; n-- {
+		bit, err := self.readBit()
+		if err != nil {
+			return 0, err
+		}
+		value <<= 1
+		if bit {
+			value |= 1
+		}
+	}
+	return value, nil
+}
+
+func PackFloat32Array(array []float32) []byte {
+	w := &bitWriter{buf: make([]byte, 0, 64)}
+	if len(array) == 0 {
+		return w.buf
+	}
+	prev := math.Float32bits(array[0])
+	w.writeBits(uint64(prev), 32)
+	prev_leading, prev_trailing := uint(33), uint(0)
+
+	for _, f := range array[1:] {
+		cur := math.Float32bits(f)
+		xor := cur ^ prev
+		prev = cur
+		if xor == 0 {
+			w.writeBit(false)
+			continue
+		}
+		w.writeBit(true)
+		leading := uint(bits.LeadingZeros32(xor))
+		trailing := uint(bits.TrailingZeros32(xor))
+		if leading > 31 {
+			leading = 31
+		}
+		if prev_leading <= 32 && leading >= prev_leading && trailing >= prev_trailing {
+			// meaningful bits fit into the previous window
+			w.writeBit(false)
+			w.writeBits(uint64(xor>>prev_trailing), 32-prev_leading-prev_trailing)
+			continue
+		}
+		w.writeBit(true)
+		meaningful := 32 - leading - trailing
+		w.writeBits(uint64(leading), 5)
+		w.writeBits(uint64(meaningful-1), 5)
+		w.writeBits(uint64(xor>>trailing), meaningful)
+		prev_leading, prev_trailing = leading, trailing
+	}
+	return w.buf
+}
+
+func UnpackFloat32Array(packed []byte, length int) ([]float32, error) {
+	array := make([]float32, length)
+	if length == 0 {
+		return array, nil
+	}
+	r := &bitReader{buf: packed}
+	first, err := r.readBits(32)
+	if err != nil {
+		return nil, err
+	}
+	prev := uint32(first)
+	array[0] = math.Float32frombits(prev)
+	leading, trailing := uint(0), uint(0)
+
+	for i := 1; i < length; i++ {
+		changed, err := r.readBit()
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			new_window, err := r.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if new_window {
+				l, err := r.readBits(5)
+				if err != nil {
+					return nil, err
+				}
+				m, err := r.readBits(5)
+				if err != nil {
+					return nil, err
+				}
+				leading = uint(l)
+				if leading+uint(m)+1 > 32 {
+					return nil, ErrCorruptPackedArray
+				}
+				trailing = 32 - leading - uint(m) - 1
+			}
+			xor, err := r.readBits(32 - leading - trailing)
+			if err != nil {
+				return nil, err
+			}
+			prev ^= uint32(xor) << trailing
+		}
+		array[i] = math.Float32frombits(prev)
+	}
+	return array, nil
+}
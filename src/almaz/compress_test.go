@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_PackRoundTrip(t *testing.T) {
+	arrays := [][]float32{
+		{},
+		{0},
+		{42},
+		{0, 0, 0, 0, 0, 0},
+		{1, 1, 2, 2, 3, 0, 0, 0, 17.5, -4, 1e30, float32(math.Inf(1)), 0},
+		{math.SmallestNonzeroFloat32, math.MaxFloat32, -math.MaxFloat32, 0.1, 0.2, 0.3},
+	}
+	r := rand.New(rand.NewSource(1))
+	random := make([]float32, 1440)
+	for i := range random {
+		random[i] = r.Float32() * 1000
+	}
+	arrays = append(arrays, random)
+
+	for _, array := range arrays {
+		packed := PackFloat32Array(array)
+		unpacked, err := UnpackFloat32Array(packed, len(array))
+		AssertEqual(t, err, nil)
+		AssertEqual(t, unpacked, array)
+	}
+}
+
+func Test_PackZerosAreCheap(t *testing.T) {
+	array := make([]float32, 1440)
+	array[100] = 5
+	packed := PackFloat32Array(array)
+	if len(packed) > 200 {
+		t.Errorf("1440 mostly-zero buckets packed into %d bytes", len(packed))
+	}
+}
+
+func Test_UnpackTruncated(t *testing.T) {
+	array := []float32{1, 2, 3, 4, 5}
+	packed := PackFloat32Array(array)
+	_, err := UnpackFloat32Array(packed[:len(packed)-1], len(array))
+	AssertEqual(t, err, ErrCorruptPackedArray)
+}
+
+func Test_SnapshotCompatibility(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almaz-test")
+	AssertEqual(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	for _, compress := range []bool{false, true} {
+		s := NewStorage()
+		s.SetStorageParams(1, 10)
+		s.SetSnapshotCompression(compress)
+		s.StoreMetric("a.b.c", 10, 55)
+		s.StoreMetric("a.b.c", 12, 72)
+		s.StoreMetric("a.b.d", 3, 66)
+		s.SetTotal("a.b.d", 100)
+
+		path := filepath.Join(dir, "almaz.dat")
+		AssertEqual(t, s.SaveToFile(path), nil)
+
+		loaded := NewStorage()
+		AssertEqual(t, loaded.LoadFromFile(path), nil)
+		AssertEqual(t, loaded.MetricCount(), 2)
+		for name, m := range s.metrics {
+			lm := loaded.metrics[name]
+			AssertEqual(t, lm.array, m.array)
+			AssertEqual(t, lm.latest_i, m.latest_i)
+			AssertEqual(t, lm.latest_ts_k, m.latest_ts_k)
+			AssertEqual(t, lm.total, m.total)
+			AssertEqual(t, lm.splitName, m.splitName)
+		}
+	}
+}
+
+// syntheticStorage builds a day of minutely data resembling statsd output:
+// mostly idle counters, steady gauges and a share of noisy series.
+
+func Test_SnapshotWhileStoring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almaz-test")
+	AssertEqual(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	s := NewStorage()
+	s.SetStorageParams(1, 10)
+	s.StoreMetric("busy", 1, 100)
+	done := make(chan bool)
+	go func() {
+		for i := int64(0); i < 1000; i++ {
+			s.StoreMetric("busy", 1, 100+i*10)
+		}
+		close(done)
+	}()
+	for _, compress := range []bool{false, true, false, true} {
+		s.SetSnapshotCompression(compress)
+		AssertEqual(t, s.SaveToFile(filepath.Join(dir, "almaz.dat")), nil)
+	}
+	<-done
+}
+func syntheticStorage(n int) *Storage {
+	r := rand.New(rand.NewSource(42))
+	s := NewStorage()
+	s.SetStorageParams(24, 60)
+	now := int64(1377447313)
+	for i := 0; i < n; i++ {
+		m := NewMetric(s.duration, s.dt, now-int64(s.duration), "")
+		kind := i % 10
+		gauge := float32(r.Intn(100))
+		for j := range m.array {
+			switch {
+			case kind < 6: // sparse counter
+				if r.Intn(20) == 0 {
+					m.array[j] = float32(r.Intn(10) + 1)
+				}
+			case kind < 8: // gauge which rarely changes
+				if r.Intn(100) == 0 {
+					gauge = float32(r.Intn(100))
+				}
+				m.array[j] = gauge
+			default: // busy timer
+				m.array[j] = r.Float32() * 500
+			}
+		}
+		m.latest_ts_k = now / int64(s.dt)
+		s.metrics[fmt.Sprintf("stats_counts.adv.shows.%d.%d.%d", i%7, i%31, i)] = m
+	}
+	return s
+}
+
+func benchmarkSnapshot(b *testing.B, compress bool) {
+	s := syntheticStorage(2000)
+	s.SetSnapshotCompression(compress)
+	dir, err := ioutil.TempDir("", "almaz-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "almaz.dat")
+
+	b.Run("save", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := s.SaveToFile(path); err != nil {
+				b.Fatal(err)
+			}
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportMetric(float64(info.Size()), "file-bytes")
+		b.ReportMetric(float64(info.Size())/float64(len(s.metrics)), "bytes/metric")
+	})
+	b.Run("load", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			loaded := NewStorage()
+			if err := loaded.LoadFromFile(path); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func Benchmark_SnapshotGob(b *testing.B) {
+	benchmarkSnapshot(b, false)
+}
+
+func Benchmark_SnapshotCompressed(b *testing.B) {
+	benchmarkSnapshot(b, true)
+}
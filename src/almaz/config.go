@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Config holds every setting of almaz. It is built from command-line options
+// and then, if --config is given, overridden by the JSON config file, whose
+// keys are the names of the options:
+//
+//	{
+//	  "fwd-address": "graphite1:2004,graphite2:2004",
+//	  "filter": ["deny ^stats\\.runaway\\.", "allow ^stats\\."],
+//	  "rewrite": ["rename ^stats_counts\\.(.*)$ stats.$1"]
+//	}
+//
+// Rule lists ("filter", "rewrite", "aggregation", "rollup", "prune",
+// "prometheus") are applied after rules from the corresponding files.
+// On SIGHUP the config is read again and applied atomically; an invalid
+// config is rejected as a whole.
+type Config struct {
+	Address             string `json:"address"`
+	HttpAddress         string `json:"http-address"`
+	FwdAddress          string `json:"fwd-address"`
+	FwdMode             string `json:"fwd-mode"`
+	FwdReplication      int    `json:"fwd-replication"`
+	FwdRegex            string `json:"fwd-regex"`
+	FwdQueueSize        int    `json:"fwd-queue-size"`
+	FwdBatchSize        int    `json:"fwd-batch-size"`
+	FwdSpoolDir         string `json:"fwd-spool-dir"`
+	FwdSpoolBytes       int64  `json:"fwd-spool-max-bytes"`
+	FwdRollup           bool   `json:"fwd-rollup"`
+	FwdRollupDelay      int    `json:"fwd-rollup-delay"`
+	FwdRollupRules      string `json:"fwd-rollup-rules"`
+	AggregationRules    string `json:"aggregation-rules"`
+	AggregationDelay    int    `json:"aggregation-delay"`
+	Audit               bool   `json:"audit"`
+	Persist             bool   `json:"persist"`
+	PersistPath         string `json:"persist-path"`
+	PersistInterval     int    `json:"bgsave"`
+	PersistKeep         int    `json:"persist-keep"`
+	PersistCompress     bool   `json:"persist-compress"`
+	Debug               bool   `json:"debug"`
+	DurationInHours     int    `json:"duration-in-hours"`
+	PrecisionInSeconds  int    `json:"precision-in-seconds"`
+	FilterRules         string `json:"filter-rules"`
+	RewriteRules        string `json:"rewrite-rules"`
+	WhisperImport       string `json:"whisper-import"`
+	WhisperExport       string `json:"whisper-export"`
+	Cpuprofile          string `json:"cpuprofile"`
+	MaxMetrics          int    `json:"max-metrics"`
+	MaxPerPrefix        int    `json:"max-metrics-per-prefix"`
+	PrefixDepth         int    `json:"prefix-depth"`
+	MaxNewPerMinute     int    `json:"max-new-metrics-per-minute"`
+	MaxMemory           int64  `json:"max-memory"`
+	EvictPath           string `json:"evict-path"`
+	PruneInterval       int    `json:"prune-interval"`
+	PruneTTL            int    `json:"prune-ttl"`
+	PruneRules          string `json:"prune-rules"`
+	SelfPrefix          string `json:"self-prefix"`
+	PrometheusRules     string `json:"prometheus-rules"`
+	PrometheusWindow    int    `json:"prometheus-window"`
+	RemoteWriteTemplate string `json:"remote-write-template"`
+	InfluxAddress       string `json:"influx-address"`
+	InfluxTemplate      string `json:"influx-template"`
+	OpenTSDBAddress     string `json:"opentsdb-address"`
+	OpenTSDBTags        string `json:"opentsdb-tags"`
+	FutureTolerance     int    `json:"future-tolerance"`
+	FuturePolicy        string `json:"future-policy"`
+	TLSCert             string `json:"tls-cert"`
+	TLSKey              string `json:"tls-key"`
+	TLSClientCA         string `json:"tls-client-ca"`
+	ClientPrefixRules   string `json:"client-prefix-rules"`
+
+	Filter         []string `json:"filter"` // allow|deny <regex>; --regex and --deny-regex end up here
+	Rewrite        []string `json:"rewrite"`
+	Aggregation    []string `json:"aggregation"`
+	Rollup         []string `json:"rollup"`
+	Prune          []string `json:"prune"`
+	Prometheus     []string `json:"prometheus"`
+	ClientPrefixes []string `json:"client-prefixes"`
+}
+
+// restartOnlySettings lists settings which take effect only at startup.
+var restartOnlySettings = []string{"duration-in-hours", "precision-in-seconds", "address", "http-address", "influx-address", "opentsdb-address", "persist", "whisper-import", "whisper-export", "cpuprofile", "tls-cert", "tls-key", "tls-client-ca"}
+
+func ConfigFromFlags() *Config {
+	return &Config{
+		Address:             *bindAddress,
+		HttpAddress:         *httpAddress,
+		FwdAddress:          *fwdAddress,
+		FwdMode:             *fwdMode,
+		FwdReplication:      *fwdReplication,
+		FwdRegex:            *fwdRegex,
+		FwdQueueSize:        *fwdQueueSize,
+		FwdBatchSize:        *fwdBatchSize,
+		FwdSpoolDir:         *fwdSpoolDir,
+		FwdSpoolBytes:       *fwdSpoolBytes,
+		FwdRollup:           *fwdRollup,
+		FwdRollupDelay:      *fwdRollupDelay,
+		FwdRollupRules:      *fwdRollupRules,
+		AggregationRules:    *aggregationRules,
+		AggregationDelay:    *aggregationDelay,
+		Audit:               *runAudits,
+		Persist:             *persist,
+		PersistPath:         *persistPath,
+		PersistInterval:     *persistInterval,
+		PersistKeep:         *persistKeep,
+		PersistCompress:     *persistCompress,
+		Debug:               *debug,
+		DurationInHours:     *storageDuration,
+		PrecisionInSeconds:  *storagePrecision,
+		FilterRules:         *filterRulesPath,
+		RewriteRules:        *rewriteRules,
+		WhisperImport:       *whisperImport,
+		WhisperExport:       *whisperExport,
+		Cpuprofile:          *cpuprofile,
+		MaxMetrics:          *maxMetrics,
+		MaxPerPrefix:        *maxPerPrefix,
+		PrefixDepth:         *prefixDepth,
+		MaxNewPerMinute:     *maxNewPerMinute,
+		MaxMemory:           *maxMemory,
+		EvictPath:           *evictPath,
+		PruneInterval:       *pruneInterval,
+		PruneTTL:            *pruneTTL,
+		PruneRules:          *pruneRules,
+		SelfPrefix:          *selfPrefix,
+		PrometheusRules:     *prometheusRules,
+		PrometheusWindow:    *prometheusWindow,
+		RemoteWriteTemplate: *remoteWriteTemplate,
+		InfluxAddress:       *influxAddress,
+		InfluxTemplate:      *influxTemplate,
+		OpenTSDBAddress:     *openTSDBAddress,
+		OpenTSDBTags:        *openTSDBTags,
+		FutureTolerance:     *futureTolerance,
+		FuturePolicy:        *futurePolicy,
+		TLSCert:             *tlsCert,
+		TLSKey:              *tlsKey,
+		TLSClientCA:         *tlsClientCA,
+		ClientPrefixRules:   *clientPrefixRules,
+		Filter:              append([]string(nil), filterRules...), // the config file must not overwrite flags
+	}
+}
+
+// LoadConfig reads the config file (if any) over the command-line options.
+func LoadConfig(path string) (*Config, error) {
+	config := ConfigFromFlags()
+	if path == "" {
+		return config, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	dec := json.NewDecoder(file)
+	dec.DisallowUnknownFields() // a misspelled key would be silently ignored
+	err = dec.Decode(config)
+	if err == nil && dec.More() {
+		err = fmt.Errorf("unexpected data after the config object")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return config, nil
+}
+
+func (self *Config) setting(name string) interface{} {
+	v := reflect.ValueOf(self).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("json") == name {
+			return v.Field(i).Interface()
+		}
+	}
+	return nil
+}
+
+// Pipeline is everything built from a Config which the ingest path uses.
+// It is replaced as a whole when the config is reloaded.
+type Pipeline struct {
+	config           *Config
+	filter           *Filter
+	rewrite_rules    RewriteRules
+	relay            *Relay
+	rollup           bool
+	rollup_rules     []*RollupRule
+	aggregator       *Aggregator
+	aggregation      []*AggregationRule
+	prune_rules      []*PruneRule
+	prometheus_rules []*PrometheusRule
+	client_prefixes  ClientPrefixes
+}
+
+// emptyPipeline is used until a config is applied: it stores everything
+// and forwards nothing.
+var emptyPipeline = &Pipeline{config: &Config{}, filter: NewFilter()}
+
+func (self *AlmazServer) pipeline() *Pipeline {
+	if p, ok := self.current_pipeline.Load().(*Pipeline); ok {
+		return p
+	}
+	return emptyPipeline
+}
+
+func (self *AlmazServer) config() *Config {
+	return self.pipeline().config
+}
+
+// buildPipeline validates the config and builds a pipeline out of it;
+// the relay and the aggregator of the previous pipeline are reused
+// where their settings are unchanged.
+func (self *AlmazServer) buildPipeline(config *Config, previous *Pipeline) (*Pipeline, error) {
+	if config.DurationInHours <= 0 {
+		return nil, fmt.Errorf("duration must be greater than zero")
+	}
+	if config.PrecisionInSeconds <= 0 {
+		return nil, fmt.Errorf("precision must be greater than zero")
+	}
+	if config.FuturePolicy != "" && config.FuturePolicy != "reject" && config.FuturePolicy != "clamp" {
+		return nil, fmt.Errorf("bad future policy %q, expected reject or clamp", config.FuturePolicy)
+	}
+	if config.EvictPath != "" && sameSnapshotPattern(config.EvictPath, config.PersistPath) {
+		return nil, fmt.Errorf("evict path %q would be taken for persist path snapshots", config.EvictPath)
+	}
+	p := &Pipeline{config: config}
+
+	p.filter = NewFilter()
+	if config.FilterRules != "" {
+		err := p.filter.LoadRules(config.FilterRules)
+		if err != nil {
+			return nil, fmt.Errorf("bad filter rules: %s", err)
+		}
+	}
+	for _, line := range config.Filter {
+		rule, err := ParseFilterRule(line)
+		if err != nil {
+			return nil, err
+		}
+		p.filter.AddRule(rule)
+	}
+	if previous != nil {
+		p.filter.KeepHits(previous.filter)
+	}
+
+	p.rewrite_rules = make(RewriteRules, 0)
+	if config.RewriteRules != "" {
+		rules, err := LoadRewriteRules(config.RewriteRules)
+		if err != nil {
+			return nil, fmt.Errorf("bad rewrite rules: %s", err)
+		}
+		p.rewrite_rules = rules
+	}
+	for _, line := range config.Rewrite {
+		rule, err := ParseRewriteRule(line)
+		if err != nil {
+			return nil, err
+		}
+		p.rewrite_rules = append(p.rewrite_rules, rule)
+	}
+
+	if config.FwdAddress != "" {
+		var previous_relay *Relay
+		if previous != nil {
+			previous_relay = previous.relay
+		}
+		relay, err := NewRelay(&RelayParams{
+			Destinations: strings.Split(config.FwdAddress, ","),
+			Mode:         config.FwdMode,
+			Replication:  config.FwdReplication,
+			Filter:       config.FwdRegex,
+			QueueSize:    config.FwdQueueSize,
+			BatchSize:    config.FwdBatchSize,
+			SpoolDir:     config.FwdSpoolDir,
+			SpoolBytes:   config.FwdSpoolBytes,
+		}, previous_relay)
+		if err != nil {
+			return nil, fmt.Errorf("bad forwarding settings: %s", err)
+		}
+		p.relay = relay
+	}
+
+	p.rollup = config.FwdRollup
+	p.rollup_rules = make([]*RollupRule, 0)
+	if config.FwdRollupRules != "" {
+		rules, err := LoadRollupRules(config.FwdRollupRules)
+		if err != nil {
+			return nil, fmt.Errorf("bad rollup rules: %s", err)
+		}
+		p.rollup_rules = rules
+	}
+	for _, line := range config.Rollup {
+		rule, err := ParseRollupRule(line)
+		if err != nil {
+			return nil, err
+		}
+		p.rollup_rules = append(p.rollup_rules, rule)
+	}
+
+	p.prune_rules = make([]*PruneRule, 0)
+	if config.PruneRules != "" {
+		rules, err := LoadPruneRules(config.PruneRules)
+		if err != nil {
+			return nil, fmt.Errorf("bad prune rules: %s", err)
+		}
+		p.prune_rules = rules
+	}
+	for _, line := range config.Prune {
+		rule, err := ParsePruneRule(line)
+		if err != nil {
+			return nil, err
+		}
+		p.prune_rules = append(p.prune_rules, rule)
+	}
+
+	p.prometheus_rules = make([]*PrometheusRule, 0)
+	if config.PrometheusRules != "" {
+		rules, err := LoadPrometheusRules(config.PrometheusRules)
+		if err != nil {
+			return nil, fmt.Errorf("bad prometheus rules: %s", err)
+		}
+		p.prometheus_rules = rules
+	}
+	for _, line := range config.Prometheus {
+		rule, err := ParsePrometheusRule(line)
+		if err != nil {
+			return nil, err
+		}
+		p.prometheus_rules = append(p.prometheus_rules, rule)
+	}
+
+	p.client_prefixes = make(ClientPrefixes)
+	if config.ClientPrefixRules != "" {
+		err := p.client_prefixes.LoadRules(config.ClientPrefixRules)
+		if err != nil {
+			return nil, fmt.Errorf("bad client prefix rules: %s", err)
+		}
+	}
+	for _, line := range config.ClientPrefixes {
+		err := p.client_prefixes.AddRule(line)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.aggregation = make([]*AggregationRule, 0)
+	if config.AggregationRules != "" {
+		rules, err := LoadAggregationRules(config.AggregationRules)
+		if err != nil {
+			return nil, fmt.Errorf("bad aggregation rules: %s", err)
+		}
+		p.aggregation = rules
+	}
+	for _, line := range config.Aggregation {
+		rule, err := ParseAggregationRule(line)
+		if err != nil {
+			return nil, err
+		}
+		p.aggregation = append(p.aggregation, rule)
+	}
+	if len(p.aggregation) > 0 {
+		if previous != nil && previous.aggregator != nil &&
+			sameAggregationRules(previous.aggregation, p.aggregation) &&
+			previous.config.AggregationDelay == config.AggregationDelay &&
+			previous.config.PrecisionInSeconds == config.PrecisionInSeconds {
+			p.aggregator = previous.aggregator
+		} else {
+			aggregator, err := NewAggregator(p.aggregation, self.storage, config.PrecisionInSeconds, config.AggregationDelay)
+			if err != nil {
+				return nil, err
+			}
+			p.aggregator = aggregator
+		}
+	}
+	return p, nil
+}
+
+// ApplyConfig builds a pipeline from the config and switches to it.
+// On error, the current pipeline stays in place.
+func (self *AlmazServer) ApplyConfig(config *Config) error {
+	var previous *Pipeline
+	if p, ok := self.current_pipeline.Load().(*Pipeline); ok {
+		previous = p
+	}
+	requested := config
+	if previous != nil {
+		// stored metrics keep the resolution of their rings, so
+		// the storage parameters of a running server can't change
+		pinned := *config
+		pinned.DurationInHours = previous.config.DurationInHours
+		pinned.PrecisionInSeconds = previous.config.PrecisionInSeconds
+		config = &pinned
+	}
+	p, err := self.buildPipeline(config, previous)
+	if err != nil {
+		return err
+	}
+	if previous != nil {
+		for _, name := range restartOnlySettings {
+			if !reflect.DeepEqual(previous.config.setting(name), requested.setting(name)) {
+				log.Printf("config: %s changed, restart to apply", name)
+			}
+		}
+	}
+
+	self.storage.SetStorageParams(config.DurationInHours, config.PrecisionInSeconds)
+	self.storage.SetSnapshotCompression(config.PersistCompress)
+	self.limiter.SetLimits(config.MaxMetrics, config.MaxPerPrefix, config.PrefixDepth, config.MaxNewPerMinute)
+	self.storage.SetClockSkewGuard(config.FutureTolerance, config.FuturePolicy == "clamp")
+
+	var previous_relay *Relay
+	if previous != nil {
+		previous_relay = previous.relay
+	}
+	if p.relay != nil {
+		p.relay.Start(previous_relay)
+	}
+	self.current_pipeline.Store(p)
+	if previous_relay != nil {
+		previous_relay.Retire(p.relay)
+	}
+	return nil
+}
+
+func sameAggregationRules(a, b []*AggregationRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Output != b[i].Output || a[i].Frequency != b[i].Frequency ||
+			a[i].Method != b[i].Method || a[i].Input != b[i].Input {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *AlmazServer) ReloadConfig() {
+	if self.config_path == "" {
+		log.Printf("no config file to reload (see --config)")
+		return
+	}
+	config, err := LoadConfig(self.config_path)
+	if err == nil {
+		err = self.ApplyConfig(config)
+	}
+	if err != nil {
+		log.Printf("config not reloaded: %s", err)
+		return
+	}
+	log.Printf("config reloaded from %s", self.config_path)
+}
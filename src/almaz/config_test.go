@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, dir string, content string) string {
+	path := filepath.Join(dir, "almaz.json")
+	AssertEqual(t, ioutil.WriteFile(path, []byte(content), 0644), nil)
+	return path
+}
+
+func Test_LoadConfigOverridesFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almaz-test")
+	AssertEqual(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	path := writeTestConfig(t, dir, `{
+		"precision-in-seconds": 10,
+		"fwd-address": "127.0.0.1:2004",
+		"filter": ["deny ^stats\\.runaway\\."]
+	}`)
+	config, err := LoadConfig(path)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, config.PrecisionInSeconds, 10)
+	AssertEqual(t, config.DurationInHours, *storageDuration)
+	AssertEqual(t, config.FwdAddress, "127.0.0.1:2004")
+	AssertEqual(t, config.Filter, []string{`deny ^stats\.runaway\.`})
+
+	for _, bad := range []string{
+		`{"precision-in-seconds": "10"}`,
+		`{"precision-in-second": 10}`,
+		`{"precision-in-seconds": 10} {}`,
+	} {
+		path = writeTestConfig(t, dir, bad)
+		_, err = LoadConfig(path)
+		AssertEqual(t, err != nil, true)
+	}
+}
+
+func Test_LoadConfigKeepsFilterFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almaz-test")
+	AssertEqual(t, err, nil)
+	defer os.RemoveAll(dir)
+	saved := filterRules
+	defer func() { filterRules = saved }()
+	filterRules = append(make([]string, 0, 4), `allow ^stats\.`)
+
+	path := writeTestConfig(t, dir, `{"filter": ["deny ^other\\."]}`)
+	for i := 0; i < 2; i++ { // as on SIGHUP
+		config, err := LoadConfig(path)
+		AssertEqual(t, err, nil)
+		AssertEqual(t, config.Filter, []string{`deny ^other\.`})
+	}
+	AssertEqual(t, filterRules, []string{`allow ^stats\.`})
+	config, err := LoadConfig("")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, config.Filter, []string{`allow ^stats\.`})
+}
+
+func Test_ReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almaz-test")
+	AssertEqual(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	server := NewAlmazServer()
+	server.SetConfigPath(writeTestConfig(t, dir, `{
+		"duration-in-hours": 1,
+		"precision-in-seconds": 10,
+		"fwd-address": "127.0.0.1:1",
+		"filter": ["allow ^stats\\."]
+	}`))
+	server.ReloadConfig()
+	first := server.pipeline()
+	AssertEqual(t, first.filter.Accept("stats.a"), true)
+	AssertEqual(t, first.filter.Accept("other"), false)
+
+	// invalid rule: the whole config is rejected
+	writeTestConfig(t, dir, `{
+		"duration-in-hours": 1,
+		"precision-in-seconds": 10,
+		"fwd-address": "127.0.0.1:1",
+		"filter": ["allow ^other\\."],
+		"rewrite": ["rename ^(a"]
+	}`)
+	server.ReloadConfig()
+	AssertEqual(t, server.pipeline() == first, true)
+
+	writeTestConfig(t, dir, `{
+		"duration-in-hours": 1,
+		"precision-in-seconds": 10,
+		"fwd-address": "127.0.0.1:1,127.0.0.1:2",
+		"filter": ["allow ^other\\."]
+	}`)
+	server.ReloadConfig()
+	second := server.pipeline()
+	AssertEqual(t, second.filter.Accept("other.a"), true)
+	AssertEqual(t, len(second.relay.forwarders), 2)
+	AssertEqual(t, second.relay.forwarders[0] == first.relay.forwarders[0], true)
+
+	// storage parameters take effect only on restart
+	writeTestConfig(t, dir, `{
+		"duration-in-hours": 2,
+		"precision-in-seconds": 60,
+		"fwd-address": "127.0.0.1:1,127.0.0.1:2"
+	}`)
+	server.ReloadConfig()
+	third := server.pipeline()
+	AssertEqual(t, third == second, false)
+	AssertEqual(t, third.config.DurationInHours, 1)
+	AssertEqual(t, third.config.PrecisionInSeconds, 10)
+	server.storage.StoreMetric("a.b", 1, 100)
+	AssertEqual(t, server.storage.metrics["a.b"].dt, 10)
+	AssertEqual(t, len(server.storage.metrics["a.b"].array), 360)
+	third.relay.Retire(nil)
+}
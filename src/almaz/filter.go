@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// Filter decides which metrics are stored, with allow and deny rules
+// evaluated in order; the first matching rule wins. A metric which matches
+// no rule is accepted, unless there are allow rules, in which case the
+// filter works as an allow-list.
+type Filter struct {
+	rules        []*FilterRule
+	has_allow    bool
+	default_hits *int64
+}
+
+type FilterRule struct {
+	Allow   bool
+	Pattern *regexp.Regexp
+	hits    *int64 // shared with the same rule of the previous config
+}
+
+type FilterRuleStats struct {
+	Rule    string `json:"rule"`
+	Matched int64  `json:"matched"`
+}
+
+func NewFilter() *Filter {
+	f := &Filter{default_hits: new(int64)}
+	f.rules = make([]*FilterRule, 0)
+	return f
+}
+
+func (self *FilterRule) String() string {
+	if self.Allow {
+		return "allow " + self.Pattern.String()
+	}
+	return "deny " + self.Pattern.String()
+}
+
+// ParseFilterRule parses "allow <regex>" or "deny <regex>".
+func ParseFilterRule(line string) (*FilterRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 || (fields[0] != "allow" && fields[0] != "deny") {
+		return nil, fmt.Errorf("bad filter rule %q, expected allow|deny <regex>", line)
+	}
+	rx, err := regexp.Compile(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("bad filter rule %q: %s", line, err)
+	}
+	return &FilterRule{Allow: fields[0] == "allow", Pattern: rx, hits: new(int64)}, nil
+}
+
+func (self *Filter) AddRule(rule *FilterRule) {
+	self.rules = append(self.rules, rule)
+	if rule.Allow {
+		self.has_allow = true
+	}
+}
+
+// KeepHits makes rules which are also in the previous filter go on with
+// its hit counters, so that reloading the config doesn't reset them.
+func (self *Filter) KeepHits(previous *Filter) {
+	previous_rules := make(map[string][]*FilterRule)
+	for _, rule := range previous.rules {
+		previous_rules[rule.String()] = append(previous_rules[rule.String()], rule)
+	}
+	for _, rule := range self.rules {
+		same := previous_rules[rule.String()]
+		if len(same) > 0 {
+			rule.hits = same[0].hits
+			previous_rules[rule.String()] = same[1:]
+		}
+	}
+	if self.has_allow == previous.has_allow {
+		self.default_hits = previous.default_hits
+	}
+}
+
+func (self *Filter) LoadRules(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := ParseFilterRule(line)
+		if err != nil {
+			return err
+		}
+		self.AddRule(rule)
+	}
+	return scanner.Err()
+}
+
+func (self *Filter) Accept(metric string) bool {
+	for _, rule := range self.rules {
+		if rule.Pattern.MatchString(metric) {
+			atomic.AddInt64(rule.hits, 1)
+			return rule.Allow
+		}
+	}
+	atomic.AddInt64(self.default_hits, 1)
+	return !self.has_allow
+}
+
+// Stats returns how many samples each rule matched; the last entry counts
+// samples which matched no rule.
+func (self *Filter) Stats() []*FilterRuleStats {
+	stats := make([]*FilterRuleStats, 0, len(self.rules)+1)
+	for _, rule := range self.rules {
+		stats = append(stats, &FilterRuleStats{rule.String(), atomic.LoadInt64(rule.hits)})
+	}
+	default_rule := "default allow"
+	if self.has_allow {
+		default_rule = "default deny"
+	}
+	stats = append(stats, &FilterRuleStats{default_rule, atomic.LoadInt64(self.default_hits)})
+	return stats
+}
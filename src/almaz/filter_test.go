@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+)
+
+func newTestFilter(t *testing.T, lines ...string) *Filter {
+	f := NewFilter()
+	for _, line := range lines {
+		rule, err := ParseFilterRule(line)
+		AssertEqual(t, err, nil)
+		f.AddRule(rule)
+	}
+	return f
+}
+
+func Test_FilterFirstMatchWins(t *testing.T) {
+	f := newTestFilter(t, `deny ^stats\.runaway\.`, `allow ^stats\.`)
+	AssertEqual(t, f.Accept("stats.shows"), true)
+	AssertEqual(t, f.Accept("stats.runaway.123"), false)
+	AssertEqual(t, f.Accept("stats.runaway.456"), false)
+	AssertEqual(t, f.Accept("other"), false) // allow-list
+
+	stats := f.Stats()
+	AssertEqual(t, len(stats), 3)
+	AssertEqual(t, *stats[0], FilterRuleStats{`deny ^stats\.runaway\.`, 2})
+	AssertEqual(t, *stats[1], FilterRuleStats{`allow ^stats\.`, 1})
+	AssertEqual(t, *stats[2], FilterRuleStats{"default deny", 1})
+}
+
+func Test_FilterDenyOnly(t *testing.T) {
+	f := newTestFilter(t, `deny ^stats\.runaway\.`)
+	AssertEqual(t, f.Accept("stats.shows"), true)
+	AssertEqual(t, f.Accept("stats.runaway.1"), false)
+	AssertEqual(t, f.Stats()[1].Rule, "default allow")
+
+	AssertEqual(t, NewFilter().Accept("anything"), true)
+}
+
+func Test_FilterKeepHits(t *testing.T) {
+	previous := newTestFilter(t, `deny ^a\.`, `deny ^b\.`)
+	previous.Accept("a.1")
+	previous.Accept("b.1")
+	previous.Accept("c.1")
+
+	f := newTestFilter(t, `deny ^a\.`, `deny ^c\.`)
+	f.KeepHits(previous)
+	f.Accept("a.2")
+	previous.Accept("a.3") // still in use until the switch
+	stats := f.Stats()
+	AssertEqual(t, *stats[0], FilterRuleStats{`deny ^a\.`, 3})
+	AssertEqual(t, *stats[1], FilterRuleStats{`deny ^c\.`, 0})
+	AssertEqual(t, *stats[2], FilterRuleStats{"default allow", 1})
+
+	f = newTestFilter(t, `allow ^a\.`)
+	f.KeepHits(previous)
+	AssertEqual(t, *f.Stats()[1], FilterRuleStats{"default deny", 0})
+}
+
+func Test_ParseFilterRuleErrors(t *testing.T) {
+	for _, line := range []string{"allow", "permit ^a", "deny ^(a", "allow ^a ^b"} {
+		_, err := ParseFilterRule(line)
+		AssertEqual(t, err != nil, true)
+	}
+}
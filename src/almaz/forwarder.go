@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ForwarderMinBackoff   = 100 * time.Millisecond
+	ForwarderMaxBackoff   = 30 * time.Second
+	ForwarderWriteTimeout = 10 * time.Second
+)
+
+// Forwarder keeps a connection to a Carbon-compatible daemon and sends it
+// lines from a bounded in-memory queue. When the queue is full, new lines
+// spill to the disk spool, if there is one, or are dropped, so a slow or
+// dead destination never blocks the ingest path.
+type Forwarder struct {
+	address     string
+	queue       chan string
+	batch_size  int
+	spool       *Spool
+	spool_ready chan bool
+	stop        chan bool
+	stopped     int32
+	connected   int32
+	forwarded   int64
+	queued      int64
+	spilled     int64
+	dropped     int64
+}
+
+type ForwarderStats struct {
+	Address     string `json:"address"`
+	Connected   bool   `json:"connected"`
+	Forwarded   int64  `json:"forwarded"`
+	Queued      int64  `json:"queued"`
+	Spilled     int64  `json:"spilled"`
+	Dropped     int64  `json:"dropped"`
+	QueueLength int    `json:"queue_length"`
+	SpoolBytes  int64  `json:"spool_bytes"`
+}
+
+func NewForwarder(address string, queue_size int, batch_size int) *Forwarder {
+	f := &Forwarder{}
+	f.address = address
+	f.queue = make(chan string, queue_size)
+	f.batch_size = batch_size
+	f.spool_ready = make(chan bool, 1)
+	f.stop = make(chan bool)
+	return f
+}
+
+// SetSpool makes the forwarder keep lines which don't fit into memory on disk.
+// Lines already in the spool are sent before any new ones.
+func (self *Forwarder) SetSpool(spool *Spool) {
+	self.spool = spool
+}
+
+func (self *Forwarder) Start() {
+	go self.loop()
+}
+
+// Stop makes the forwarder send lines still in the memory queue and
+// disconnect. If it can't send them, they go to the spool, if there is
+// one, or are dropped. Lines enqueued after Stop are dropped.
+func (self *Forwarder) Stop() {
+	atomic.StoreInt32(&self.stopped, 1)
+	close(self.stop)
+}
+
+// Enqueue schedules a line (without trailing newline) for forwarding.
+func (self *Forwarder) Enqueue(line string) bool {
+	if atomic.LoadInt32(&self.stopped) == 1 {
+		atomic.AddInt64(&self.dropped, 1)
+		return false
+	}
+	if self.spool != nil && !self.spool.Empty() {
+		// keep the order: the spool has to drain before the memory queue is used again
+		return self.spill(line)
+	}
+	select {
+	case self.queue <- line:
+		atomic.AddInt64(&self.queued, 1)
+		return true
+	default:
+		if self.spool != nil {
+			return self.spill(line)
+		}
+		atomic.AddInt64(&self.dropped, 1)
+		return false
+	}
+}
+
+func (self *Forwarder) spill(line string) bool {
+	if !self.spool.Append(line) {
+		atomic.AddInt64(&self.dropped, 1)
+		return false
+	}
+	atomic.AddInt64(&self.spilled, 1)
+	select {
+	case self.spool_ready <- true:
+	default:
+	}
+	return true
+}
+
+func (self *Forwarder) Stats() *ForwarderStats {
+	stats := &ForwarderStats{
+		Address:     self.address,
+		Connected:   atomic.LoadInt32(&self.connected) == 1,
+		Forwarded:   atomic.LoadInt64(&self.forwarded),
+		Queued:      atomic.LoadInt64(&self.queued),
+		Spilled:     atomic.LoadInt64(&self.spilled),
+		Dropped:     atomic.LoadInt64(&self.dropped),
+		QueueLength: len(self.queue),
+	}
+	if self.spool != nil {
+		stats.SpoolBytes = self.spool.Size()
+	}
+	return stats
+}
+
+// connect returns nil if the forwarder is stopped before it connects.
+func (self *Forwarder) connect() net.Conn {
+	backoff := ForwarderMinBackoff
+	for {
+		conn, err := net.DialTimeout("tcp", self.address, ForwarderWriteTimeout)
+		if err == nil {
+			log.Printf("forwarding to %s", self.address)
+			atomic.StoreInt32(&self.connected, 1)
+			return conn
+		}
+		log.Printf("forward conn error: %s (retrying in %s)", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-self.stop:
+			return nil
+		}
+		backoff *= 2
+		if backoff > ForwarderMaxBackoff {
+			backoff = ForwarderMaxBackoff
+		}
+	}
+}
+
+func (self *Forwarder) loop() {
+	batch := make([]string, 0, self.batch_size)
+	var segment int64
+	for {
+		conn := self.connect()
+		if conn == nil {
+			if segment == 0 {
+				// lines of a spool segment are still in the spool
+				self.discard(batch)
+			}
+			self.discard(self.drainQueue())
+			return
+		}
+		w := bufio.NewWriter(conn)
+		for {
+			if len(batch) == 0 {
+				var ok bool
+				batch, segment, ok = self.nextBatch(batch)
+				if !ok {
+					log.Printf("stopped forwarding to %s", self.address)
+					conn.Close()
+					return
+				}
+			}
+			err := self.writeBatch(conn, w, batch)
+			if err != nil {
+				// the batch is kept and retried after reconnecting
+				log.Printf("forward write error: %s", err)
+				break
+			}
+			atomic.AddInt64(&self.forwarded, int64(len(batch)))
+			if segment > 0 {
+				err = self.spool.RemoveSegment(segment)
+				if err != nil {
+					log.Printf("spool error: %s", err)
+				}
+			}
+			batch = make([]string, 0, self.batch_size)
+		}
+		atomic.StoreInt32(&self.connected, 0)
+		conn.Close()
+	}
+}
+
+// nextBatch waits for at least one line and takes whatever else is
+// already queued, up to batch_size lines. Once the memory queue is empty,
+// the whole oldest segment of the spool is taken; its id is returned
+// so that it can be removed after it is sent. It returns false when
+// the forwarder is stopped and its memory queue is empty; the spool
+// is kept for the next start.
+func (self *Forwarder) nextBatch(batch []string) ([]string, int64, bool) {
+	for {
+		select {
+		case line := <-self.queue:
+			return self.fillBatch(append(batch, line)), 0, true
+		default:
+		}
+		if atomic.LoadInt32(&self.stopped) == 1 {
+			return batch, 0, false
+		}
+		if self.spool != nil && !self.spool.Empty() {
+			segment, lines, err := self.spool.ReadSegment()
+			if err != nil {
+				log.Printf("spool error, skipping segment %d: %s", segment, err)
+				self.spool.RemoveSegment(segment)
+				continue
+			}
+			return append(batch, lines...), segment, true
+		}
+		select {
+		case line := <-self.queue:
+			return self.fillBatch(append(batch, line)), 0, true
+		case <-self.spool_ready:
+		case <-self.stop:
+		}
+	}
+}
+
+func (self *Forwarder) drainQueue() []string {
+	lines := make([]string, 0, len(self.queue))
+	for {
+		select {
+		case line := <-self.queue:
+			lines = append(lines, line)
+		default:
+			return lines
+		}
+	}
+}
+
+// discard keeps lines which can't be sent in the spool, if there is one.
+func (self *Forwarder) discard(lines []string) {
+	for _, line := range lines {
+		if self.spool != nil && self.spool.Append(line) {
+			atomic.AddInt64(&self.spilled, 1)
+		} else {
+			atomic.AddInt64(&self.dropped, 1)
+		}
+	}
+}
+
+func (self *Forwarder) fillBatch(batch []string) []string {
+	for len(batch) < self.batch_size {
+		select {
+		case line := <-self.queue:
+			batch = append(batch, line)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (self *Forwarder) writeBatch(conn net.Conn, w *bufio.Writer, batch []string) error {
+	conn.SetWriteDeadline(time.Now().Add(ForwarderWriteTimeout))
+	for _, line := range batch {
+		w.WriteString(line)
+		w.WriteByte('\n')
+	}
+	return w.Flush()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// receiveLines accepts connections on listener and sends every received line to the channel.
+func receiveLines(listener net.Listener, lines chan string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+		}()
+	}
+}
+
+func expectLines(t *testing.T, lines chan string, expected ...string) {
+	for _, e := range expected {
+		select {
+		case line := <-lines:
+			AssertEqual(t, line, e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", e)
+		}
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_ForwarderReconnects(t *testing.T) {
+	// reserve an address, then close it so that the first dials fail
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	AssertEqual(t, err, nil)
+	address := listener.Addr().String()
+	listener.Close()
+
+	f := NewForwarder(address, 10, 2)
+	f.Start()
+	f.Enqueue("a.b 1 100")
+	f.Enqueue("a.b 2 100")
+	f.Enqueue("a.b 3 100")
+	time.Sleep(300 * time.Millisecond)
+	AssertEqual(t, f.Stats().Connected, false)
+
+	listener, err = net.Listen("tcp", address)
+	AssertEqual(t, err, nil)
+	defer listener.Close()
+	lines := make(chan string, 10)
+	go receiveLines(listener, lines)
+
+	expectLines(t, lines, "a.b 1 100", "a.b 2 100", "a.b 3 100")
+	waitFor(t, func() bool { return f.Stats().Forwarded == 3 })
+	stats := f.Stats()
+	AssertEqual(t, stats.Connected, true)
+	AssertEqual(t, stats.Queued, 3)
+	AssertEqual(t, stats.Forwarded, 3)
+	AssertEqual(t, stats.Dropped, 0)
+}
+
+func Test_ForwarderDropsWhenFull(t *testing.T) {
+	f := NewForwarder("127.0.0.1:1", 2, 10) // not started
+	AssertEqual(t, f.Enqueue("x 1 1"), true)
+	AssertEqual(t, f.Enqueue("x 1 2"), true)
+	AssertEqual(t, f.Enqueue("x 1 3"), false)
+	stats := f.Stats()
+	AssertEqual(t, stats.Queued, 2)
+	AssertEqual(t, stats.Dropped, 1)
+	AssertEqual(t, stats.QueueLength, 2)
+}
+
+func Test_ForwarderSendsQueueOnStop(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	AssertEqual(t, err, nil)
+	defer listener.Close()
+	lines := make(chan string, 10)
+	go receiveLines(listener, lines)
+
+	f := NewForwarder(listener.Addr().String(), 10, 2)
+	f.Enqueue("a.b 1 100")
+	f.Enqueue("a.b 2 100")
+	f.Enqueue("a.b 3 100")
+	f.Start()
+	f.Stop()
+	expectLines(t, lines, "a.b 1 100", "a.b 2 100", "a.b 3 100")
+	AssertEqual(t, f.Enqueue("a.b 4 100"), false)
+	AssertEqual(t, f.Stats().Dropped, 1)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -15,23 +16,43 @@ import (
 	"time"
 )
 
-func (self *AlmazServer) StartHttpface(bindAddress string) {
+// StartHttpface serves the http interface, over TLS if tls_config is set.
+func (self *AlmazServer) StartHttpface(bindAddress string, tls_config *tls.Config) {
 	log.Printf("Http interface available at %s", bindAddress)
 	http.HandleFunc("/", self.http_main)
-	http.HandleFunc("/list/all/", self.http_list_all)
-	http.HandleFunc("/list/all-interpolated/", self.http_list_all_smooth)
-	http.HandleFunc("/list/group/", self.http_list_group)
-	http.HandleFunc("/events/log/", self.http_log_event)
+	http.HandleFunc("/list/all/", self.timedQuery(self.http_list_all))
+	http.HandleFunc("/list/all-interpolated/", self.timedQuery(self.http_list_all_smooth))
+	http.HandleFunc("/list/group/", self.timedQuery(self.http_list_group))
+	http.HandleFunc("/events/log/", self.unrestricted(self.http_log_event))
 	http.HandleFunc("/events/index.html", self.static_factory("events_index.html", "text/html"))
 	http.HandleFunc("/events/", self.http_scan_events)
-	http.HandleFunc("/almaz/list/all/", self.http_list_all)
-	http.HandleFunc("/almaz/list/all-interpolated/", self.http_list_all_smooth)
-	http.HandleFunc("/almaz/list/group/", self.http_list_group)
+	http.HandleFunc("/almaz/list/all/", self.timedQuery(self.http_list_all))
+	http.HandleFunc("/almaz/list/all-interpolated/", self.timedQuery(self.http_list_all_smooth))
+	http.HandleFunc("/almaz/list/group/", self.timedQuery(self.http_list_group))
 	http.HandleFunc("/almaz/stream/", self.http_stream)
-	http.HandleFunc("/almaz/load/totals/", self.http_load_totals)
-	http.HandleFunc("/almaz/events/log/", self.http_log_event)
+	http.HandleFunc("/almaz/load/totals/", self.unrestricted(self.http_load_totals))
+	http.HandleFunc("/almaz/events/log/", self.unrestricted(self.http_log_event))
 	http.HandleFunc("/almaz/events/index.html", self.static_factory("events_index.html", "text/html"))
 	http.HandleFunc("/almaz/events/", self.http_scan_events)
+	http.HandleFunc("/metrics", self.http_prometheus_metrics)
+	http.HandleFunc("/api/v1/write", self.http_remote_write)
+	http.HandleFunc("/write", self.http_influx_write)
+	http.HandleFunc("/api/put", self.http_opentsdb_put)
+	http.HandleFunc("/tags", self.http_tags)
+	http.HandleFunc("/tags/", self.http_tags)
+	http.HandleFunc("/almaz/ingest", self.http_ingest)
+	http.HandleFunc("/almaz/admin/filters/", self.unrestricted(self.http_filter_stats))
+	http.HandleFunc("/almaz/admin/forwarder/", self.unrestricted(self.http_forwarder_stats))
+	http.HandleFunc("/almaz/admin/limits/", self.unrestricted(self.http_limit_stats))
+	http.HandleFunc("/almaz/admin/memory/", self.unrestricted(self.http_memory_stats))
+	http.HandleFunc("/almaz/admin/rewrite/", self.unrestricted(self.http_rewrite_dry_run))
+	http.HandleFunc("/almaz/admin/senders/", self.unrestricted(self.http_sender_stats))
+	http.HandleFunc("/almaz/admin/snapshots/", self.unrestricted(self.http_list_snapshots))
+	http.HandleFunc("/almaz/admin/snapshots/restore/", self.unrestricted(self.http_restore_snapshot))
+	if tls_config != nil {
+		server := &http.Server{Addr: bindAddress, TLSConfig: tls_config}
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
 	http.ListenAndServe(bindAddress, nil)
 }
 
@@ -56,9 +77,9 @@ func (self *AlmazServer) http_list_all_with_interpolation(w http.ResponseWriter,
 	periods := []int64{60, 15 * 60, 60 * 60, 4 * 60 * 60, 24 * 60 * 60}
 	now := time.Now().Unix()
 
-	for k := range self.storage.metrics {
+	for k, metric := range self.storage.Metrics() {
 		fmt.Fprintf(w, "%s", k)
-		counts_per_period := self.storage.metrics[k].GetSumsPerPeriodUntilNowWithInterpolation(periods, now, interpolate)
+		counts_per_period := metric.GetSumsPerPeriodUntilNowWithInterpolation(periods, now, interpolate)
 		for _, el := range counts_per_period {
 			fmt.Fprintf(w, "\t%f", el)
 		}
@@ -98,7 +119,17 @@ func (self *AlmazServer) http_list_group(w http.ResponseWriter, r *http.Request)
 
 	groups := make([]string, 0)
 	for scanner.Scan() {
-		groups = append(groups, scanner.Text())
+		group := scanner.Text()
+		if IsSeriesByTag(group) {
+			_, err := ParseSeriesByTag(group)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "400 Bad Request\r\n")
+				fmt.Fprintf(w, "%s", err)
+				return
+			}
+		}
+		groups = append(groups, group)
 	}
 
 	var results [][]float64
@@ -145,7 +176,7 @@ func (self *AlmazServer) http_stream(w http.ResponseWriter, r *http.Request) {
 	sub := NewStreamSubscriber(ws)
 	self.AddSubscriber(sub)
 
-	sub.conn.WriteMessage(websocket.TextMessage, self.last_pushed_update)
+	sub.conn.WriteMessage(websocket.TextMessage, self.last_pushed_update.Load().([]byte))
 
 	for {
 		_, _, err := ws.ReadMessage()
@@ -195,6 +226,125 @@ func (self *AlmazServer) http_scan_events(w http.ResponseWriter, r *http.Request
 	w.Write(json_bytes)
 }
 
+func (self *AlmazServer) http_filter_stats(w http.ResponseWriter, r *http.Request) {
+	stats := self.pipeline().filter.Stats()
+
+	json_bytes, err := json.Marshal(&stats)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error while formatting json response: %s", err), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json_bytes)
+}
+
+func (self *AlmazServer) http_limit_stats(w http.ResponseWriter, r *http.Request) {
+	stats := self.limiter.Stats()
+
+	json_bytes, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error while formatting json response: %s", err), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json_bytes)
+}
+
+func (self *AlmazServer) http_memory_stats(w http.ResponseWriter, r *http.Request) {
+	stats := self.MemoryStats()
+
+	json_bytes, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error while formatting json response: %s", err), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json_bytes)
+}
+
+func (self *AlmazServer) http_forwarder_stats(w http.ResponseWriter, r *http.Request) {
+	stats := make([]*ForwarderStats, 0)
+	if relay := self.pipeline().relay; relay != nil {
+		stats = relay.Stats()
+	}
+
+	json_bytes, err := json.Marshal(&stats)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error while formatting json response: %s", err), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json_bytes)
+}
+
+func (self *AlmazServer) http_rewrite_dry_run(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "name argument is mandatory", 400)
+		return
+	}
+	names, steps := self.pipeline().rewrite_rules.Trace(name)
+	result := struct {
+		Name   string         `json:"name"`
+		Result []string       `json:"result"`
+		Steps  []*RewriteStep `json:"steps"`
+	}{name, names, steps}
+
+	json_bytes, err := json.Marshal(&result)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error while formatting json response: %s", err), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json_bytes)
+}
+
+func (self *AlmazServer) http_list_snapshots(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := ListSnapshots(self.config().PersistPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error while listing snapshots: %s", err), 500)
+		return
+	}
+
+	json_bytes, err := json.Marshal(&snapshots)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error while formatting json response: %s", err), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json_bytes)
+}
+
+func (self *AlmazServer) http_restore_snapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "use POST method", 405)
+		return
+	}
+	name := r.FormValue("name")
+	mode := r.FormValue("mode")
+	if mode != "replace" && mode != "merge" {
+		http.Error(w, "mode must be either replace or merge", 400)
+		return
+	}
+	snapshot := FindSnapshot(self.config().PersistPath, name)
+	if snapshot == nil {
+		http.Error(w, fmt.Sprintf("no such snapshot: %s", name), 404)
+		return
+	}
+	err := self.RestoreSnapshot(snapshot, mode == "replace")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error while restoring snapshot: %s", err), 500)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
 func (self *AlmazServer) static_factory(path string, content_type string) http.HandlerFunc {
 	full_path := GetExecutableDir() + "/" + path
 
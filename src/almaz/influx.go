@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// InfluxDB line protocol, as sent by Telegraf:
+//
+//   cpu,host=web1,cpu=cpu0 usage_idle=92.5,usage_user=3i 1377447313000000000
+//
+// Every numeric field becomes a metric named by --influx-template, where
+// {measurement}, {field} and {tag} are replaced like in ExpandNameTemplate,
+// e.g. telegraf.{host}.{measurement}.{field}. Booleans are stored as 1 and 0,
+// string fields are ignored. Timestamps are in nanoseconds unless the
+// precision argument of /write says otherwise; points without timestamps
+// are stored at the time they are received.
+
+type InfluxPoint struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      []*InfluxField
+	Timestamp   int64 // in units of precision, 0 if missing
+}
+
+type InfluxField struct {
+	Key   string
+	Value float64
+}
+
+var ErrInfluxStringField = errors.New("string field")
+
+// influxPrecisions maps the precision argument of /write to nanoseconds.
+var influxPrecisions = map[string]int64{
+	"":   1,
+	"ns": 1,
+	"n":  1,
+	"us": 1000,
+	"u":  1000,
+	"ms": 1000000,
+	"s":  1000000000,
+	"m":  60 * 1000000000,
+	"h":  3600 * 1000000000,
+}
+
+// influxScan returns the part of s up to the first unescaped character
+// from stops, and the rest starting with that character. Inside double
+// quotes (field values) stops don't count.
+func influxScan(s string, stops string, quotes bool) (string, string) {
+	in_quotes := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' {
+			i++
+			continue
+		}
+		if quotes && c == '"' {
+			in_quotes = !in_quotes
+			continue
+		}
+		if !in_quotes && strings.IndexByte(stops, c) >= 0 {
+			return s[:i], s[i:]
+		}
+	}
+	return s, ""
+}
+
+var influxUnescaper = strings.NewReplacer(`\,`, ",", `\ `, " ", `\=`, "=", `\\`, `\`)
+
+func influxKeyValue(s string, quotes bool) (string, string, error) {
+	key, rest := influxScan(s, "=", false)
+	if key == "" || rest == "" {
+		return "", "", fmt.Errorf("expected key=value, got %q", s)
+	}
+	value := rest[1:]
+	if value == "" {
+		return "", "", fmt.Errorf("missing value of %s", key)
+	}
+	if !quotes {
+		value = influxUnescaper.Replace(value)
+	}
+	return influxUnescaper.Replace(key), value, nil
+}
+
+func parseInfluxFieldValue(s string) (float64, error) {
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		if len(s) < 2 || !strings.HasSuffix(s, `"`) {
+			return 0, fmt.Errorf("unterminated string %s", s)
+		}
+		return 0, ErrInfluxStringField
+	}
+	if strings.HasSuffix(s, "i") {
+		v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return float64(v), err
+	}
+	if strings.HasSuffix(s, "u") {
+		v, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		return float64(v), err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// ParseInfluxLine parses a line of the Influx line protocol.
+func ParseInfluxLine(line string) (*InfluxPoint, error) {
+	key, rest := influxScan(line, " ", false)
+	if key == "" || rest == "" {
+		return nil, fmt.Errorf("bad line %q: expected measurement and fields", line)
+	}
+	point := &InfluxPoint{Tags: make(map[string]string)}
+
+	measurement, tags := influxScan(key, ",", false)
+	point.Measurement = influxUnescaper.Replace(measurement)
+	if point.Measurement == "" {
+		return nil, fmt.Errorf("bad line %q: missing measurement", line)
+	}
+	for tags != "" {
+		var tag string
+		tag, tags = influxScan(tags[1:], ",", false)
+		k, v, err := influxKeyValue(tag, false)
+		if err != nil {
+			return nil, fmt.Errorf("bad line %q: %s", line, err)
+		}
+		point.Tags[k] = v
+	}
+
+	fields, rest := influxScan(strings.TrimLeft(rest, " "), " ", true)
+	if fields == "" {
+		return nil, fmt.Errorf("bad line %q: missing fields", line)
+	}
+	fields = "," + fields
+	for fields != "" {
+		var field string
+		field, fields = influxScan(fields[1:], ",", true)
+		k, v, err := influxKeyValue(field, true)
+		if err != nil {
+			return nil, fmt.Errorf("bad line %q: %s", line, err)
+		}
+		value, err := parseInfluxFieldValue(v)
+		if err == ErrInfluxStringField {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad line %q: field %s: %s", line, k, err)
+		}
+		point.Fields = append(point.Fields, &InfluxField{k, value})
+	}
+
+	rest = strings.TrimSpace(rest)
+	if rest != "" {
+		ts, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad line %q: bad timestamp %s", line, rest)
+		}
+		point.Timestamp = ts
+	}
+	return point, nil
+}
+
+// processInfluxLine stores and forwards numeric fields of a line;
+// precision is the unit of timestamps in nanoseconds.
+func (self *AlmazServer) processInfluxLine(sender *Sender, line string, precision int64, metric_updates []*MetricUpdate) ([]*MetricUpdate, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return metric_updates, nil
+	}
+	point, err := ParseInfluxLine(line)
+	if err != nil {
+		atomic.AddInt64(&self.counters.parse_errors, 1)
+		self.senders.Failed(sender, line, err)
+		return metric_updates, err
+	}
+	ts := time.Now().Unix()
+	if point.Timestamp != 0 {
+		ts = point.Timestamp * precision / 1e9
+	}
+	template := self.config().InfluxTemplate
+	values := make(map[string]string, len(point.Tags)+2)
+	for k, v := range point.Tags {
+		values[k] = v
+	}
+	values["measurement"] = point.Measurement
+	for _, field := range point.Fields {
+		values["field"] = field.Key
+		name, ok := ExpandNameTemplate(template, values)
+		if !ok {
+			atomic.AddInt64(&self.counters.rejected, 1)
+			continue
+		}
+		metric_updates, _ = self.ingestValue(sender, name, field.Value, ts, metric_updates)
+	}
+	return metric_updates, nil
+}
+
+// StartInflux listens for the Influx line protocol on TCP and UDP; with
+// tls_config set, on TCP over TLS only.
+func (self *AlmazServer) StartInflux(bindAddress string, tls_config *tls.Config) {
+	if tls_config == nil {
+		udp, err := net.ListenPacket("udp", bindAddress)
+		if err != nil {
+			log.Fatalf("failed to listen: %s", err)
+		}
+		go self.handleInfluxPackets(udp)
+	}
+
+	listener, err := net.Listen("tcp", bindAddress)
+	if err != nil {
+		log.Fatalf("failed to listen: %s", err)
+	}
+	if tls_config != nil {
+		listener = tls.NewListener(listener, tls_config)
+		log.Printf("listening for Influx line protocol on %s (TLS, no UDP)", bindAddress)
+	} else {
+		log.Printf("listening for Influx line protocol on %s", bindAddress)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf(err.Error())
+			continue
+		}
+		go self.handleInfluxConnection(conn)
+	}
+}
+
+func (self *AlmazServer) handleInfluxConnection(conn net.Conn) {
+	defer conn.Close()
+	metric_updates := make([]*MetricUpdate, 0)
+	sender := self.ConnectionSender(conn)
+	if sender == nil {
+		return
+	}
+	lines, bytes := 0, 0
+	var flushed time.Time // the first line is counted at once
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var err error
+		line := scanner.Text()
+		metric_updates, err = self.processInfluxLine(sender, line, 1, metric_updates)
+		if err != nil {
+			log.Printf("influx: %s: %s", sender.Host, err)
+		}
+		lines, bytes = lines+1, bytes+len(line)+1
+		if lines == SenderFlushLines || time.Since(flushed) >= SenderFlushInterval {
+			self.senders.Seen(sender, lines, bytes)
+			lines, bytes = 0, 0
+			flushed = time.Now()
+		}
+	}
+	self.senders.Seen(sender, lines, bytes)
+	go self.PushUpstream(metric_updates)
+}
+
+func (self *AlmazServer) handleInfluxPackets(conn net.PacketConn) {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("influx: %s", err)
+			continue
+		}
+		sender := self.NewSender(addr.String(), nil)
+		lines := strings.Split(strings.TrimSpace(string(buf[:n])), "\n")
+		self.senders.Seen(sender, len(lines), n)
+		metric_updates := make([]*MetricUpdate, 0)
+		for _, line := range lines {
+			metric_updates, err = self.processInfluxLine(sender, line, 1, metric_updates)
+			if err != nil {
+				log.Printf("influx: %s: %s", sender.Host, err)
+			}
+		}
+		go self.PushUpstream(metric_updates)
+	}
+}
+
+// http_influx_write is the /write endpoint of InfluxDB. Valid lines are
+// stored even if some lines are malformed; the first error is returned.
+func (self *AlmazServer) http_influx_write(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "use POST method", 405)
+		return
+	}
+	precision, ok := influxPrecisions[r.FormValue("precision")]
+	if !ok {
+		http.Error(w, fmt.Sprintf("bad precision: %s", r.FormValue("precision")), 400)
+		return
+	}
+	defer r.Body.Close()
+	body, ok, err := readIngestBody(r, IngestMaxBytes)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error while reading request: %s", err), 400)
+		return
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("request is larger than %d bytes", IngestMaxBytes), 413)
+		return
+	}
+	sender := self.NewSender(r.RemoteAddr, r.TLS)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	self.senders.Seen(sender, len(lines), len(body))
+	var first_err error
+	metric_updates := make([]*MetricUpdate, 0)
+	for _, line := range lines {
+		metric_updates, err = self.processInfluxLine(sender, line, precision, metric_updates)
+		if err != nil && first_err == nil {
+			first_err = err
+		}
+	}
+	go self.PushUpstream(metric_updates)
+	if first_err != nil {
+		http.Error(w, first_err.Error(), 400)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_ParseInfluxLine(t *testing.T) {
+	point, err := ParseInfluxLine(`cpu,host=web1,cpu=cpu0 usage_idle=92.5,usage_user=3i,up=t,note="a, b=c" 1377447313000000000`)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, point.Measurement, "cpu")
+	AssertEqual(t, point.Tags, map[string]string{"host": "web1", "cpu": "cpu0"})
+	AssertEqual(t, len(point.Fields), 3) // the string field is skipped
+	AssertEqual(t, *point.Fields[0], InfluxField{"usage_idle", 92.5})
+	AssertEqual(t, *point.Fields[1], InfluxField{"usage_user", 3})
+	AssertEqual(t, *point.Fields[2], InfluxField{"up", 1})
+	AssertEqual(t, point.Timestamp, int64(1377447313000000000))
+
+	point, err = ParseInfluxLine(`mem free=10u`)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(point.Tags), 0)
+	AssertEqual(t, point.Timestamp, int64(0))
+	AssertEqual(t, *point.Fields[0], InfluxField{"free", 10})
+}
+
+func Test_ParseInfluxLineEscaping(t *testing.T) {
+	point, err := ParseInfluxLine(`disk\ io,path=/var\,log,label=a\=b,dc=eu\ west read\ bytes=1,msg="quoted \" space" 100`)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, point.Measurement, "disk io")
+	AssertEqual(t, point.Tags, map[string]string{"path": "/var,log", "label": "a=b", "dc": "eu west"})
+	AssertEqual(t, len(point.Fields), 1)
+	AssertEqual(t, point.Fields[0].Key, "read bytes")
+	AssertEqual(t, point.Timestamp, int64(100))
+}
+
+func Test_ParseInfluxLineMalformed(t *testing.T) {
+	for _, line := range []string{
+		`cpu`,
+		`cpu `,
+		`,host=a value=1`,
+		`cpu,host value=1`,
+		`cpu,host= value=1`,
+		`cpu value`,
+		`cpu value=`,
+		`cpu value=abc`,
+		`cpu value=1x`,
+		`cpu value="unterminated`,
+		`cpu value=1 12ab`,
+		`cpu value=1.5i`,
+	} {
+		_, err := ParseInfluxLine(line)
+		AssertEqual(t, err != nil, true)
+	}
+}
+
+func Test_InfluxWrite(t *testing.T) {
+	server := NewAlmazServer()
+	err := server.ApplyConfig(&Config{
+		DurationInHours:    1,
+		PrecisionInSeconds: 10,
+		InfluxTemplate:     "telegraf.{host}.{measurement}.{field}",
+	})
+	AssertEqual(t, err, nil)
+
+	body := "cpu,host=web1.example.com usage_user=3,usage_system=2 100\n" +
+		"cpu usage_user=1 100\n" + // no host tag
+		"bad line\n" +
+		"mem,host=web1 used=5 110\n"
+	w := httptest.NewRecorder()
+	server.http_influx_write(w, httptest.NewRequest("POST", "/write?precision=s", strings.NewReader(body)))
+	AssertEqual(t, w.Code, 400)
+	AssertEqual(t, server.storage.MetricCount(), 3)
+	AssertEqual(t, server.storage.metrics["telegraf.web1_example_com.cpu.usage_user"].GetValueAt(100), 3)
+	AssertEqual(t, server.storage.metrics["telegraf.web1.mem.used"].GetValueAt(110), 5)
+
+	w = httptest.NewRecorder()
+	server.http_influx_write(w, httptest.NewRequest("POST", "/write", strings.NewReader("mem,host=web1 used=7,load=0.0000002 120000000000\n")))
+	AssertEqual(t, w.Code, 204)
+	AssertEqual(t, server.storage.metrics["telegraf.web1.mem.used"].GetValueAt(120), 7)
+	AssertEqual(t, server.storage.metrics["telegraf.web1.mem.load"].GetValueAt(120), float64(float32(2e-7)))
+
+	w = httptest.NewRecorder()
+	server.http_influx_write(w, httptest.NewRequest("POST", "/write?precision=m", strings.NewReader("disk,host=web1 used=3 2\n")))
+	AssertEqual(t, w.Code, 204)
+	AssertEqual(t, server.storage.metrics["telegraf.web1.disk.used"].GetValueAt(120), 3)
+	w = httptest.NewRecorder()
+	server.http_influx_write(w, httptest.NewRequest("POST", "/write?precision=h", strings.NewReader("swap,host=web1 used=4 1\n")))
+	AssertEqual(t, w.Code, 204)
+	AssertEqual(t, server.storage.metrics["telegraf.web1.swap.used"].GetValueAt(3600), 4)
+}
+
+func Test_InfluxWriteGzip(t *testing.T) {
+	server := NewAlmazServer()
+	err := server.ApplyConfig(&Config{DurationInHours: 1, PrecisionInSeconds: 10, InfluxTemplate: "telegraf.{measurement}.{field}"})
+	AssertEqual(t, err, nil)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("mem used=5 110\n"))
+	gz.Close()
+	r := httptest.NewRequest("POST", "/write?precision=s", &buf)
+	r.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	server.http_influx_write(w, r)
+	AssertEqual(t, w.Code, 204)
+	AssertEqual(t, server.storage.metrics["telegraf.mem.used"].GetValueAt(110), 5)
+
+	r = httptest.NewRequest("POST", "/write?precision=s", strings.NewReader("mem used=5 110\n"))
+	r.Header.Set("Content-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	server.http_influx_write(w, r)
+	AssertEqual(t, w.Code, 400)
+}
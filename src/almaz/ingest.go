@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// POST /almaz/ingest accepts samples over http, for senders which can't
+// reach the Carbon port: either Carbon lines
+//
+//   stats.shows.a 1 1377447313
+//
+// or a JSON list of samples:
+//
+//   [{"metric": "stats.shows.a", "value": 1, "ts": 1377447313}]
+//
+// Samples go through the same filters, rewrite rules, limits and
+// forwarding as those received on the Carbon port.
+
+// IngestMaxBytes limits the size of an ingest request; larger ones
+// are refused as a whole.
+const IngestMaxBytes = 32 << 20
+
+type IngestSample struct {
+	Metric string   `json:"metric"`
+	Value  *float64 `json:"value"`
+	Ts     int64    `json:"ts"` // 0 or -1 --- the time of receipt
+}
+
+type IngestError struct {
+	Line  int    `json:"line"` // number of the line or of the JSON sample, from 1
+	Error string `json:"error"`
+}
+
+type IngestResult struct {
+	Accepted  int            `json:"accepted"`
+	Rejected  int            `json:"rejected"`
+	Malformed int            `json:"malformed"`
+	Errors    []*IngestError `json:"errors"`
+}
+
+var ErrNotCarbonLine = errors.New("expected: metric value [timestamp]")
+
+// add counts the outcome of line (or sample) n.
+func (self *IngestResult) add(n int, outcome lineOutcome) {
+	self.Accepted += outcome.accepted
+	self.Rejected += outcome.rejected
+	if outcome.err != nil {
+		self.Malformed++
+		self.Errors = append(self.Errors, &IngestError{n, outcome.err.Error()})
+	}
+}
+
+func (self *IngestSample) Validate() error {
+	if self.Metric == "" || strings.ContainsAny(self.Metric, " \t\r\n") {
+		return fmt.Errorf("bad metric %q", self.Metric)
+	}
+	if self.Value == nil {
+		return fmt.Errorf("missing value of %s", self.Metric)
+	}
+	return nil
+}
+
+// isCarbonLine tells whether the line is a sample, as opposed to
+// a line ingestLine would forward as it is.
+func isCarbonLine(line string) bool {
+	if strings.HasPrefix(line, "put ") {
+		return true
+	}
+	fields := strings.Count(line, " ") + 1
+	return fields == 2 || fields == 3
+}
+
+// readIngestBody reads at most max bytes of the request body, decompressed
+// if it is gzipped; it returns false if the body is larger.
+func readIngestBody(r *http.Request, max int64) ([]byte, bool, error) {
+	reader := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, true, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(reader, max+1))
+	if err != nil {
+		return nil, true, err
+	}
+	return body, int64(len(body)) <= max, nil
+}
+
+func (self *AlmazServer) http_ingest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "use POST method", 405)
+		return
+	}
+	defer r.Body.Close()
+	body, ok, err := readIngestBody(r, IngestMaxBytes)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error while reading request: %s", err), 400)
+		return
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("request is larger than %d bytes", IngestMaxBytes), 413)
+		return
+	}
+
+	sender := self.NewSender(r.RemoteAddr, r.TLS)
+	result := &IngestResult{Errors: make([]*IngestError, 0)}
+	metric_updates := make([]*MetricUpdate, 0)
+	body = bytes.TrimSpace(body)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") || bytes.HasPrefix(body, []byte("[")) {
+		samples := make([]*IngestSample, 0)
+		err = json.Unmarshal(body, &samples)
+		if err != nil {
+			self.senders.Seen(sender, 0, len(body))
+			self.senders.Failed(sender, "", err)
+			http.Error(w, fmt.Sprintf("error while decoding request: %s", err), 400)
+			return
+		}
+		self.senders.Seen(sender, len(samples), len(body))
+		for i, sample := range samples {
+			err := sample.Validate()
+			if err != nil {
+				atomic.AddInt64(&self.counters.parse_errors, 1)
+				result.add(i+1, lineOutcome{err: err})
+				sample_json, _ := json.Marshal(sample)
+				self.senders.Failed(sender, string(sample_json), err)
+				continue
+			}
+			ts := sample.Ts
+			if ts <= 0 {
+				ts = time.Now().Unix() // missing, stamped on receipt
+			}
+			var outcome lineOutcome
+			metric_updates, outcome = self.ingestValue(sender, sample.Metric, *sample.Value, ts, metric_updates)
+			result.add(i+1, outcome)
+		}
+	} else {
+		lines := strings.Split(string(body), "\n")
+		self.senders.Seen(sender, len(lines), len(body))
+		for i, line := range lines {
+			line = strings.TrimRight(line, "\r")
+			if line == "" {
+				continue
+			}
+			if !isCarbonLine(line) {
+				// ingestLine would forward it as it is
+				atomic.AddInt64(&self.counters.parse_errors, 1)
+				result.add(i+1, lineOutcome{err: ErrNotCarbonLine})
+				self.senders.Failed(sender, line, ErrNotCarbonLine)
+				continue
+			}
+			var outcome lineOutcome
+			metric_updates, outcome = self.ingestLine(sender, line, metric_updates)
+			result.add(i+1, outcome)
+		}
+	}
+	go self.PushUpstream(metric_updates)
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error while encoding result: %s", err), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Ingest(t *testing.T) {
+	server := NewAlmazServer()
+	err := server.ApplyConfig(&Config{DurationInHours: 1, PrecisionInSeconds: 10,
+		FilterRules: "", Filter: []string{"deny ^junk\\."}})
+	AssertEqual(t, err, nil)
+
+	body := "a.b 1 100\r\na.b 2 100\njunk.a 1 100\n\na.c x 100\nput a.d 100 3 host=web1\nnot a carbon line\n"
+	w := httptest.NewRecorder()
+	server.http_ingest(w, httptest.NewRequest("POST", "/almaz/ingest", strings.NewReader(body)))
+	AssertEqual(t, w.Code, 200)
+	AssertEqual(t, w.Body.String(), `{"accepted":3,"rejected":1,"malformed":2,"errors":[`+
+		`{"line":5,"error":"strconv.ParseFloat: parsing \"x\": invalid syntax"},`+
+		`{"line":7,"error":"expected: metric value [timestamp]"}]}`)
+	AssertEqual(t, server.storage.metrics["a.b"].GetValueAt(100), 3)
+	AssertEqual(t, server.storage.metrics["a.d.web1"].GetValueAt(100), 3)
+
+	body = `[{"metric": "a.b", "value": 4, "ts": 100}, {"metric": "a b", "value": 1}, {"metric": "a.e", "ts": 100}]`
+	w = httptest.NewRecorder()
+	server.http_ingest(w, httptest.NewRequest("POST", "/almaz/ingest", strings.NewReader(body)))
+	AssertEqual(t, w.Code, 200)
+	AssertEqual(t, w.Body.String(), `{"accepted":1,"rejected":0,"malformed":2,"errors":[`+
+		`{"line":2,"error":"bad metric \"a b\""},{"line":3,"error":"missing value of a.e"}]}`)
+	AssertEqual(t, server.storage.metrics["a.b"].GetValueAt(100), 7)
+
+	// zeros are not stored, but denied ones still count as rejected
+	w = httptest.NewRecorder()
+	server.http_ingest(w, httptest.NewRequest("POST", "/almaz/ingest", strings.NewReader("junk.z 0 100\na.z 0 100\n")))
+	AssertEqual(t, w.Body.String(), `{"accepted":1,"rejected":1,"malformed":0,"errors":[]}`)
+	AssertEqual(t, server.pipeline().filter.Stats()[0].Matched, 2)
+
+	w = httptest.NewRecorder()
+	server.http_ingest(w, httptest.NewRequest("POST", "/almaz/ingest", strings.NewReader(`[{"metric": 1}`)))
+	AssertEqual(t, w.Code, 400)
+	w = httptest.NewRecorder()
+	server.http_ingest(w, httptest.NewRequest("GET", "/almaz/ingest", nil))
+	AssertEqual(t, w.Code, 405)
+}
+
+func Test_IngestDoesNotForwardMalformed(t *testing.T) {
+	fwd, err := net.Listen("tcp", "127.0.0.1:0")
+	AssertEqual(t, err, nil)
+	defer fwd.Close()
+	server := NewAlmazServer()
+	err = server.ApplyConfig(&Config{DurationInHours: 1, PrecisionInSeconds: 10,
+		FwdAddress: fwd.Addr().String(), FwdMode: RelayModeAll, FwdReplication: 1, FwdQueueSize: 10, FwdBatchSize: 10})
+	AssertEqual(t, err, nil)
+	forwarded := make(chan string, 10)
+	go receiveLines(fwd, forwarded)
+
+	w := httptest.NewRecorder()
+	server.http_ingest(w, httptest.NewRequest("POST", "/almaz/ingest", strings.NewReader("not a carbon line\na.b 1 100\n")))
+	AssertEqual(t, w.Body.String(), `{"accepted":1,"rejected":0,"malformed":1,"errors":[{"line":1,"error":"expected: metric value [timestamp]"}]}`)
+	expectLines(t, forwarded, "a.b 1 100")
+	select {
+	case line := <-forwarded:
+		t.Errorf("forwarded %q", line)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func Test_ReadIngestBody(t *testing.T) {
+	body, ok, err := readIngestBody(httptest.NewRequest("POST", "/almaz/ingest", strings.NewReader("a.b 1 100")), 9)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, ok, true)
+	AssertEqual(t, string(body), "a.b 1 100")
+	_, ok, err = readIngestBody(httptest.NewRequest("POST", "/almaz/ingest", strings.NewReader("a.b 1 1000")), 9)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, ok, false)
+}
+
+func Test_DefaultTimestamps(t *testing.T) {
+	server := NewAlmazServer()
+	err := server.ApplyConfig(&Config{DurationInHours: 1, PrecisionInSeconds: 10, FutureTolerance: 600})
+	AssertEqual(t, err, nil)
+	now := time.Now().Unix()
+	server.processLine("a.b 1", nil)
+	server.processLine("a.b 2 N", nil)
+	server.processLine("a.b 4 -1", nil)
+	AssertEqual(t, server.storage.metrics["a.b"].GetSumBetween(now-10, now+10), 7)
+
+	_, outcome := server.ingestLine(nil, fmt.Sprintf("a.c 1 %d", now+3600), nil)
+	AssertEqual(t, outcome.rejected, 1)
+	AssertEqual(t, server.storage.HasMetric("a.c"), false)
+	_, outcome = server.ingestLine(nil, fmt.Sprintf("a.c 1 %d", now+60), nil)
+	AssertEqual(t, outcome.accepted, 1)
+
+	body := `[{"metric": "a.d", "value": 1}, {"metric": "a.d", "value": 2, "ts": -1}]`
+	w := httptest.NewRecorder()
+	server.http_ingest(w, httptest.NewRequest("POST", "/almaz/ingest", strings.NewReader(body)))
+	AssertEqual(t, server.storage.metrics["a.d"].GetSumBetween(now-10, now+10), 3)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	LimitMaxMetrics          = "max-metrics"
+	LimitMaxMetricsPerPrefix = "max-metrics-per-prefix"
+	LimitNewMetricsPerMinute = "max-new-metrics-per-minute"
+)
+
+// Limiter guards the storage against metric name explosions (like request
+// ids in names): it decides whether a new metric may be created. Samples of
+// existing metrics are never rejected. A limit of 0 means no limit.
+type Limiter struct {
+	sync.Mutex
+	max_metrics        int
+	max_per_prefix     int
+	prefix_depth       int
+	max_new_per_minute int
+	metrics            int
+	prefixes           map[string]*prefixUsage
+	minute             int64
+	new_this_minute    int
+	rejected           map[string]int64 // by limit
+}
+
+type prefixUsage struct {
+	metrics  int
+	rejected int64
+}
+
+type LimiterStats struct {
+	Metrics                int              `json:"metrics"`
+	MaxMetrics             int              `json:"max_metrics"`
+	MaxMetricsPerPrefix    int              `json:"max_metrics_per_prefix"`
+	PrefixDepth            int              `json:"prefix_depth"`
+	MaxNewMetricsPerMinute int              `json:"max_new_metrics_per_minute"`
+	NewMetricsThisMinute   int              `json:"new_metrics_this_minute"`
+	Rejected               map[string]int64 `json:"rejected"`
+	Offending              []*PrefixStats   `json:"offending"` // prefixes with rejected samples
+	Largest                []*PrefixStats   `json:"largest"`
+}
+
+type PrefixStats struct {
+	Prefix   string `json:"prefix"`
+	Metrics  int    `json:"metrics"`
+	Rejected int64  `json:"rejected"`
+}
+
+// LimiterLargestPrefixes is how many prefixes with most metrics Stats shows.
+const LimiterLargestPrefixes = 20
+
+func NewLimiter() *Limiter {
+	l := &Limiter{}
+	l.prefix_depth = 1
+	l.prefixes = make(map[string]*prefixUsage)
+	l.rejected = make(map[string]int64)
+	return l
+}
+
+// SetLimits changes limits; quotas apply to prefixes of prefix_depth name components.
+func (self *Limiter) SetLimits(max_metrics, max_per_prefix, prefix_depth, max_new_per_minute int) {
+	self.Lock()
+	defer self.Unlock()
+	self.max_metrics = max_metrics
+	self.max_per_prefix = max_per_prefix
+	self.max_new_per_minute = max_new_per_minute
+	if prefix_depth < 1 {
+		prefix_depth = 1
+	}
+	if prefix_depth != self.prefix_depth {
+		self.prefix_depth = prefix_depth
+		self.prefixes = make(map[string]*prefixUsage)
+	}
+}
+
+func (self *Limiter) prefixOf(name string) string {
+	parts := strings.SplitN(name, ".", self.prefix_depth+1)
+	if len(parts) > self.prefix_depth {
+		parts = parts[:self.prefix_depth]
+	}
+	return strings.Join(parts, ".")
+}
+
+func (self *Limiter) usage(prefix string) *prefixUsage {
+	usage, ok := self.prefixes[prefix]
+	if !ok {
+		usage = &prefixUsage{}
+		self.prefixes[prefix] = usage
+	}
+	return usage
+}
+
+// AdmitNew is called before a new metric is created at `now` (unix time).
+// It returns the name of the exceeded limit, or "" if the metric may be created.
+func (self *Limiter) AdmitNew(name string, now int64) string {
+	self.Lock()
+	defer self.Unlock()
+	if now/60 != self.minute {
+		self.minute = now / 60
+		self.new_this_minute = 0
+	}
+	usage := self.usage(self.prefixOf(name))
+	limit := ""
+	if self.max_metrics > 0 && self.metrics >= self.max_metrics {
+		limit = LimitMaxMetrics
+	} else if self.max_per_prefix > 0 && usage.metrics >= self.max_per_prefix {
+		limit = LimitMaxMetricsPerPrefix
+	} else if self.max_new_per_minute > 0 && self.new_this_minute >= self.max_new_per_minute {
+		limit = LimitNewMetricsPerMinute
+	}
+	if limit != "" {
+		if usage.rejected == 0 {
+			log.Printf("rejecting new metrics under %s: %s exceeded", self.prefixOf(name), limit)
+		}
+		usage.rejected++
+		self.rejected[limit]++
+		return limit
+	}
+	usage.metrics++
+	self.metrics++
+	self.new_this_minute++
+	return ""
+}
+
+// Recount updates metric counts after metrics were removed or loaded in bulk.
+func (self *Limiter) Recount(metrics map[string]*Metric) {
+	self.Lock()
+	defer self.Unlock()
+	for prefix, usage := range self.prefixes {
+		if usage.rejected == 0 {
+			delete(self.prefixes, prefix)
+		} else {
+			usage.metrics = 0
+		}
+	}
+	for name := range metrics {
+		self.usage(self.prefixOf(name)).metrics++
+	}
+	self.metrics = len(metrics)
+}
+
+func (self *Limiter) Stats() *LimiterStats {
+	self.Lock()
+	defer self.Unlock()
+	stats := &LimiterStats{
+		Metrics:                self.metrics,
+		MaxMetrics:             self.max_metrics,
+		MaxMetricsPerPrefix:    self.max_per_prefix,
+		PrefixDepth:            self.prefix_depth,
+		MaxNewMetricsPerMinute: self.max_new_per_minute,
+		NewMetricsThisMinute:   self.new_this_minute,
+		Rejected:               make(map[string]int64),
+		Offending:              make([]*PrefixStats, 0),
+	}
+	for limit, n := range self.rejected {
+		stats.Rejected[limit] = n
+	}
+	all := make([]*PrefixStats, 0, len(self.prefixes))
+	for prefix, usage := range self.prefixes {
+		ps := &PrefixStats{prefix, usage.metrics, usage.rejected}
+		all = append(all, ps)
+		if usage.rejected > 0 {
+			stats.Offending = append(stats.Offending, ps)
+		}
+	}
+	sort.Slice(stats.Offending, func(i, j int) bool {
+		return stats.Offending[i].Rejected > stats.Offending[j].Rejected
+	})
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Metrics > all[j].Metrics
+	})
+	if len(all) > LimiterLargestPrefixes {
+		all = all[:LimiterLargestPrefixes]
+	}
+	stats.Largest = all
+	return stats
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func Test_LimiterQuotas(t *testing.T) {
+	l := NewLimiter()
+	l.SetLimits(4, 2, 2, 0)
+	AssertEqual(t, l.AdmitNew("stats.web.a", 100), "")
+	AssertEqual(t, l.AdmitNew("stats.web.b", 100), "")
+	AssertEqual(t, l.AdmitNew("stats.web.c", 100), LimitMaxMetricsPerPrefix)
+	AssertEqual(t, l.AdmitNew("stats.db.a", 100), "")
+	AssertEqual(t, l.AdmitNew("other", 100), "")
+	AssertEqual(t, l.AdmitNew("stats.api.a", 100), LimitMaxMetrics)
+
+	stats := l.Stats()
+	AssertEqual(t, stats.Metrics, 4)
+	AssertEqual(t, stats.Rejected, map[string]int64{LimitMaxMetricsPerPrefix: 1, LimitMaxMetrics: 1})
+	AssertEqual(t, len(stats.Offending), 2)
+	AssertEqual(t, stats.Largest[0], &PrefixStats{"stats.web", 2, 1})
+
+	// removed metrics free the quota
+	l.Recount(map[string]*Metric{"stats.web.a": nil})
+	AssertEqual(t, l.AdmitNew("stats.web.c", 100), "")
+	AssertEqual(t, l.Stats().Metrics, 2)
+}
+
+func Test_LimiterNewMetricsPerMinute(t *testing.T) {
+	l := NewLimiter()
+	l.SetLimits(0, 0, 1, 2)
+	AssertEqual(t, l.AdmitNew("a", 120), "")
+	AssertEqual(t, l.AdmitNew("b", 150), "")
+	AssertEqual(t, l.AdmitNew("c", 179), LimitNewMetricsPerMinute)
+	AssertEqual(t, l.AdmitNew("c", 180), "")
+}
+
+func Test_ProcessLineLimits(t *testing.T) {
+	server := NewAlmazServer()
+	err := server.ApplyConfig(&Config{DurationInHours: 1, PrecisionInSeconds: 10, MaxMetrics: 1})
+	AssertEqual(t, err, nil)
+
+	server.processLine("a 1 100", nil)
+	updates := server.processLine("b 1 100", nil)
+	AssertEqual(t, len(updates), 0)
+	updates = server.processLine("a 1 110", nil)
+	AssertEqual(t, len(updates), 1)
+	AssertEqual(t, server.storage.MetricCount(), 1)
+	AssertEqual(t, server.limiter.Stats().Rejected[LimitMaxMetrics], int64(1))
+}
+
+func Test_ConcurrentNewMetricAdmittedOnce(t *testing.T) {
+	server := NewAlmazServer()
+	err := server.ApplyConfig(&Config{DurationInHours: 1, PrecisionInSeconds: 10, MaxMetrics: 2})
+	AssertEqual(t, err, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.processLine("a 1 100", nil)
+		}()
+	}
+	wg.Wait()
+	AssertEqual(t, server.storage.metrics["a"].GetValueAt(100), 20)
+	AssertEqual(t, server.limiter.Stats().Metrics, 1)
+
+	// metrics set by the aggregator and self stats are limited too
+	AssertEqual(t, server.storage.SetMetricValue("b", 1, 100), true)
+	AssertEqual(t, server.storage.SetMetricValue("c", 1, 100), false)
+	AssertEqual(t, server.storage.SetMetricValue("b", 2, 100), true)
+	AssertEqual(t, server.storage.HasMetric("c"), false)
+	AssertEqual(t, server.limiter.Stats().Rejected[LimitMaxMetrics], int64(1))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MemoryCheckInterval is how often --max-memory is enforced; the budget
+// can be exceeded in between.
+const MemoryCheckInterval = 10 * time.Second
+
+// EvictLogBatch is how many evicted names are logged per line.
+const EvictLogBatch = 100
+
+// MemoryStats describes memory taken by metric rings (--max-memory).
+type MemoryStats struct {
+	RingBytes int64 `json:"ring_bytes"`
+	MaxMemory int64 `json:"max_memory"`
+	Metrics   int   `json:"metrics"`
+	Evicted   int64 `json:"evicted"`
+}
+
+func (self *Metric) touch() {
+	atomic.StoreInt64(&self.last_access, time.Now().Unix())
+}
+
+func (self *Metric) LastAccess() int64 {
+	return atomic.LoadInt64(&self.last_access)
+}
+
+// RingBytes is the memory taken by values of the metric.
+func (self *Metric) RingBytes() int64 {
+	return int64(len(self.array)) * 4
+}
+
+func (self *Storage) RingBytes() int64 {
+	self.RLock()
+	defer self.RUnlock()
+	return self.ringBytes()
+}
+
+func (self *Storage) ringBytes() int64 {
+	var total int64
+	for _, metric := range self.metrics {
+		total += metric.RingBytes()
+	}
+	return total
+}
+
+// LeastRecentlyUsed returns names of metrics which were least recently
+// written or queried, as many as needed to fit rings into max_bytes.
+func (self *Storage) LeastRecentlyUsed(max_bytes int64) []string {
+	self.RLock()
+	defer self.RUnlock()
+	return self.leastRecentlyUsed(max_bytes)
+}
+
+func (self *Storage) leastRecentlyUsed(max_bytes int64) []string {
+	total := self.ringBytes()
+	if total <= max_bytes {
+		return nil
+	}
+	names := make([]string, 0, len(self.metrics))
+	for name := range self.metrics {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ai, aj := self.metrics[names[i]].LastAccess(), self.metrics[names[j]].LastAccess()
+		if ai != aj {
+			return ai < aj
+		}
+		return names[i] < names[j]
+	})
+	for i, name := range names {
+		if total <= max_bytes {
+			return names[:i]
+		}
+		total -= self.metrics[name].RingBytes()
+	}
+	return names
+}
+
+// Evict removes least recently used metrics beyond max_bytes and returns
+// them. Like PruneIdle, it picks candidates under the read lock and checks
+// them again under the write lock: a metric written or queried in between
+// is kept.
+func (self *Storage) Evict(max_bytes int64) map[string]*Metric {
+	self.RLock()
+	candidates := make(map[string]int64)
+	for _, name := range self.leastRecentlyUsed(max_bytes) {
+		candidates[name] = self.metrics[name].LastAccess()
+	}
+	self.RUnlock()
+	evicted := make(map[string]*Metric, len(candidates))
+	if len(candidates) == 0 {
+		return evicted
+	}
+
+	self.Lock()
+	defer self.Unlock()
+	for name, last_access := range candidates {
+		metric, ok := self.metrics[name]
+		if ok && metric.LastAccess() == last_access {
+			delete(self.metrics, name)
+			self.unindexTags(name)
+			evicted[name] = metric
+		}
+	}
+	return evicted
+}
+
+func (self *AlmazServer) MemoryLoop() {
+	for {
+		time.Sleep(MemoryCheckInterval)
+		self.EnforceMemoryBudget()
+	}
+}
+
+// EnforceMemoryBudget evicts least recently used metrics beyond --max-memory,
+// saving them to --evict-path first if it is set.
+func (self *AlmazServer) EnforceMemoryBudget() {
+	config := self.config()
+	if config.MaxMemory <= 0 {
+		return
+	}
+	evicted := self.storage.Evict(config.MaxMemory)
+	if len(evicted) == 0 {
+		return
+	}
+	atomic.AddInt64(&self.evicted, int64(len(evicted)))
+	self.limiter.Recount(self.storage.Metrics())
+	log.Printf("Memory budget exceeded: %d least recently used metrics evicted", len(evicted))
+
+	names := make([]string, 0, len(evicted))
+	for name := range evicted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i := 0; i < len(names); i += EvictLogBatch {
+		end := i + EvictLogBatch
+		if end > len(names) {
+			end = len(names)
+		}
+		log.Printf("evicted: %s", strings.Join(names[i:end], " "))
+	}
+
+	if config.EvictPath != "" {
+		path := NewSnapshotPath(config.EvictPath, time.Now())
+		evicted_storage := NewStorage()
+		evicted_storage.metrics = evicted
+		evicted_storage.SetSnapshotCompression(self.storage.SnapshotCompression())
+		err := evicted_storage.SaveToFile(path)
+		if err != nil {
+			log.Printf("Error while saving evicted metrics: %s", err)
+		} else {
+			log.Printf("Saved %d evicted metrics to %s", len(evicted), path)
+		}
+	}
+}
+
+func (self *AlmazServer) MemoryStats() *MemoryStats {
+	return &MemoryStats{
+		RingBytes: self.storage.RingBytes(),
+		MaxMemory: self.config().MaxMemory,
+		Metrics:   self.storage.MetricCount(),
+		Evicted:   atomic.LoadInt64(&self.evicted),
+	}
+}
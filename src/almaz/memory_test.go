@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func Test_LeastRecentlyUsed(t *testing.T) {
+	s := NewStorage()
+	s.SetStorageParams(1, 10) // 360 values, 1440 bytes per metric
+	for _, name := range []string{"a", "b", "c", "d"} {
+		s.StoreMetric(name, 1, 100)
+	}
+	s.metrics["a"].last_access = 40
+	s.metrics["b"].last_access = 10
+	s.metrics["c"].last_access = 30
+	s.metrics["d"].last_access = 20
+
+	AssertEqual(t, s.RingBytes(), int64(4*1440))
+	AssertEqual(t, len(s.LeastRecentlyUsed(4*1440)), 0)
+	AssertEqual(t, s.LeastRecentlyUsed(2*1440), []string{"b", "d"})
+	AssertEqual(t, s.LeastRecentlyUsed(2*1440+1), []string{"b", "d"})
+	AssertEqual(t, s.LeastRecentlyUsed(0), []string{"b", "d", "c", "a"})
+
+	s.SumByPeriodGroupingQuery([]string{"b"}, []int64{60}, 100, false)
+	AssertEqual(t, s.LeastRecentlyUsed(3*1440), []string{"d"})
+}
+
+func Test_EnforceMemoryBudget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almaz-test")
+	AssertEqual(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	evict_path := filepath.Join(dir, "evicted.dat")
+	server := NewAlmazServer()
+	err = server.ApplyConfig(&Config{
+		DurationInHours:    1,
+		PrecisionInSeconds: 10,
+		MaxMemory:          1440,
+		EvictPath:          evict_path,
+	})
+	AssertEqual(t, err, nil)
+	server.storage.StoreMetric("old", 1, 100)
+	server.storage.StoreMetric("new", 2, 100)
+	server.storage.metrics["old"].last_access = 1
+
+	server.EnforceMemoryBudget()
+	AssertEqual(t, server.storage.MetricCount(), 1)
+	AssertEqual(t, server.storage.HasMetric("new"), true)
+	AssertEqual(t, server.MemoryStats().Evicted, int64(1))
+
+	snapshots, err := ListSnapshots(evict_path)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(snapshots), 1)
+	evicted, err := ReadMetricsFromFile(snapshots[0].path)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, evicted["old"].GetValueAt(100), 1)
+
+	// evictions within the same second don't overwrite each other
+	server.storage.StoreMetric("newer", 4, 100)
+	server.storage.metrics["new"].last_access = 1
+	server.EnforceMemoryBudget()
+	server.storage.StoreMetric("newest", 8, 100)
+	server.storage.metrics["newer"].last_access = 1
+	server.EnforceMemoryBudget()
+	snapshots, err = ListSnapshots(evict_path)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(snapshots) >= 2, true)
+	evicted_names := make([]string, 0)
+	for _, snapshot := range snapshots {
+		metrics, err := ReadMetricsFromFile(snapshot.path)
+		AssertEqual(t, err, nil)
+		for name := range metrics {
+			evicted_names = append(evicted_names, name)
+		}
+	}
+	sort.Strings(evicted_names)
+	AssertEqual(t, evicted_names, []string{"new", "newer", "old"})
+}
+
+func Test_EvictPathSnapshots(t *testing.T) {
+	server := NewAlmazServer()
+	config := &Config{
+		DurationInHours:    1,
+		PrecisionInSeconds: 10,
+		PersistPath:        "data/almaz.dat",
+		EvictPath:          "data/../data/almaz.dat",
+	}
+	AssertEqual(t, server.ApplyConfig(config) != nil, true)
+	config.EvictPath = "data/evicted.dat"
+	AssertEqual(t, server.ApplyConfig(config), nil)
+}
+
+func Test_Evict(t *testing.T) {
+	s := NewStorage()
+	s.SetStorageParams(1, 10)
+	s.StoreMetric("a", 1, 100)
+	s.StoreMetric("b", 2, 100)
+	s.metrics["a"].last_access = 10
+	s.metrics["b"].last_access = 20
+
+	evicted := s.Evict(1440)
+	AssertEqual(t, len(evicted), 1)
+	AssertEqual(t, evicted["a"].GetValueAt(100), 1)
+	AssertEqual(t, s.HasMetric("a"), false)
+	AssertEqual(t, s.HasMetric("b"), true)
+	AssertEqual(t, len(s.Evict(1440)), 0)
+}
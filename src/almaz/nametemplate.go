@@ -0,0 +1,32 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Name templates turn tagged samples (Prometheus, Influx, OpenTSDB) into
+// dotted names: {tag} is replaced with the value of the tag, e.g.
+// prometheus.{job}.{instance}.{__name__}.
+
+var (
+	nameTemplateTagRegex    = regexp.MustCompile(`\{[^{}]+\}`)
+	nameTemplateUnsafeRegex = regexp.MustCompile(`[^a-zA-Z0-9_:\-]`)
+)
+
+// ExpandNameTemplate fills the template with tag values. Characters other
+// than letters, digits, _, : and - are replaced with _ in the values, so that
+// a value is always a single name component. It returns false if the template
+// refers to a missing tag.
+func ExpandNameTemplate(template string, tags map[string]string) (string, bool) {
+	ok := true
+	name := nameTemplateTagRegex.ReplaceAllStringFunc(template, func(ref string) string {
+		value, found := tags[strings.Trim(ref, "{}")]
+		if !found || value == "" {
+			ok = false
+			return ""
+		}
+		return nameTemplateUnsafeRegex.ReplaceAllString(value, "_")
+	})
+	return name, ok
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_ExpandNameTemplate(t *testing.T) {
+	tags := map[string]string{"__name__": "up", "instance": "web1.example.com:9090"}
+	name, ok := ExpandNameTemplate("prometheus.{instance}.{__name__}", tags)
+	AssertEqual(t, ok, true)
+	AssertEqual(t, name, "prometheus.web1_example_com:9090.up")
+	_, ok = ExpandNameTemplate("prometheus.{job}.{__name__}", tags)
+	AssertEqual(t, ok, false)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// OpenTSDB put lines are accepted on the Carbon port, detected by the
+// "put" command, and at /api/put of the http interface:
+//
+//   put sys.cpu.user 1377447313 42 host=web1 cpu=0
+//
+// Tags are folded into the name: values of tags listed in --opentsdb-tags
+// come first, in that order, followed by values of other tags sorted by
+// tag name, e.g. sys.cpu.user.web1.0 with --opentsdb-tags=host.
+
+type OpenTSDBPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"` // seconds or milliseconds
+	Value     json.Number       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+func ParseOpenTSDBPut(line string) (*OpenTSDBPoint, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || fields[0] != "put" {
+		return nil, fmt.Errorf("bad put %q, expected put <metric> <timestamp> <value> [tag=value ...]", line)
+	}
+	ts, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad put %q: bad timestamp", line)
+	}
+	point := &OpenTSDBPoint{Metric: fields[1], Timestamp: ts, Value: json.Number(fields[3])}
+	point.Tags = make(map[string]string)
+	for _, tag := range fields[4:] {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("bad put %q: bad tag %s", line, tag)
+		}
+		point.Tags[parts[0]] = parts[1]
+	}
+	return point, nil
+}
+
+// FoldTags appends tag values to the metric name, tags from order first.
+func FoldTags(metric string, tags map[string]string, order []string) string {
+	parts := []string{metric}
+	used := make(map[string]bool)
+	for _, k := range order {
+		if v, ok := tags[k]; ok {
+			parts = append(parts, nameTemplateUnsafeRegex.ReplaceAllString(v, "_"))
+			used[k] = true
+		}
+	}
+	rest := make([]string, 0)
+	for k := range tags {
+		if !used[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	for _, k := range rest {
+		parts = append(parts, nameTemplateUnsafeRegex.ReplaceAllString(tags[k], "_"))
+	}
+	return strings.Join(parts, ".")
+}
+
+// Sample returns the name, with tags folded into it, the value and
+// the timestamp in seconds of the point.
+func (self *OpenTSDBPoint) Sample(tag_order []string) (string, float64, int64, error) {
+	if self.Metric == "" || strings.ContainsAny(self.Metric, " \t\r\n") {
+		return "", 0, 0, fmt.Errorf("bad metric %q", self.Metric)
+	}
+	value, err := strconv.ParseFloat(self.Value.String(), 64)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("bad value of %s: %q", self.Metric, self.Value)
+	}
+	ts := self.Timestamp
+	if ts > 9999999999 {
+		ts /= 1000 // milliseconds
+	}
+	return FoldTags(self.Metric, self.Tags, tag_order), value, ts, nil
+}
+
+func openTSDBTagOrder(config *Config) []string {
+	if config.OpenTSDBTags == "" {
+		return nil
+	}
+	return strings.Split(config.OpenTSDBTags, ",")
+}
+
+// ingestOpenTSDBPut is ingestLine for a put line.
+func (self *AlmazServer) ingestOpenTSDBPut(sender *Sender, line string, metric_updates []*MetricUpdate) ([]*MetricUpdate, lineOutcome) {
+	point, err := ParseOpenTSDBPut(line)
+	var name string
+	var value float64
+	var ts int64
+	if err == nil {
+		name, value, ts, err = point.Sample(openTSDBTagOrder(self.config()))
+	}
+	if err != nil {
+		atomic.AddInt64(&self.counters.parse_errors, 1)
+		self.senders.Failed(sender, line, err)
+		return metric_updates, lineOutcome{err: err}
+	}
+	return self.ingestValue(sender, name, value, ts, metric_updates)
+}
+
+// http_opentsdb_put is /api/put of OpenTSDB: a JSON point or a list of points.
+func (self *AlmazServer) http_opentsdb_put(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "use POST method", 405)
+		return
+	}
+	defer r.Body.Close()
+	body, ok, err := readIngestBody(r, IngestMaxBytes)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error while reading request: %s", err), 400)
+		return
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("request is larger than %d bytes", IngestMaxBytes), 413)
+		return
+	}
+	sender := self.NewSender(r.RemoteAddr, r.TLS)
+	points := make([]*OpenTSDBPoint, 0)
+	body = bytes.TrimSpace(body)
+	if bytes.HasPrefix(body, []byte("[")) {
+		err = json.Unmarshal(body, &points)
+	} else {
+		point := &OpenTSDBPoint{}
+		err = json.Unmarshal(body, point)
+		points = append(points, point)
+	}
+	if err != nil {
+		self.senders.Seen(sender, 0, len(body))
+		self.senders.Failed(sender, "", err)
+		http.Error(w, fmt.Sprintf("error while decoding request: %s", err), 400)
+		return
+	}
+	self.senders.Seen(sender, len(points), len(body))
+
+	tag_order := openTSDBTagOrder(self.config())
+	failed := 0
+	metric_updates := make([]*MetricUpdate, 0)
+	for _, point := range points {
+		name, value, ts, err := point.Sample(tag_order)
+		if err != nil {
+			atomic.AddInt64(&self.counters.parse_errors, 1)
+			point_json, _ := json.Marshal(point)
+			self.senders.Failed(sender, string(point_json), err)
+			failed++
+			continue
+		}
+		metric_updates, _ = self.ingestValue(sender, name, value, ts, metric_updates)
+	}
+	go self.PushUpstream(metric_updates)
+	if failed > 0 {
+		http.Error(w, fmt.Sprintf("%d of %d points are malformed", failed, len(points)), 400)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
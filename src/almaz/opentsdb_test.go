@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_ParseOpenTSDBPut(t *testing.T) {
+	point, err := ParseOpenTSDBPut("put sys.cpu.user 1377447313 42.5 host=web1 cpu=0")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, point.Metric, "sys.cpu.user")
+	AssertEqual(t, point.Timestamp, int64(1377447313))
+	AssertEqual(t, point.Tags, map[string]string{"host": "web1", "cpu": "0"})
+	name, value, ts, err := point.Sample([]string{"host"})
+	AssertEqual(t, err, nil)
+	AssertEqual(t, name, "sys.cpu.user.web1.0")
+	AssertEqual(t, value, 42.5)
+	AssertEqual(t, ts, int64(1377447313))
+
+	for _, bad := range []string{"put sys.cpu 1377447313", "put sys.cpu now 1", "put sys.cpu 1 2 host"} {
+		_, err := ParseOpenTSDBPut(bad)
+		AssertEqual(t, err != nil, true)
+	}
+	point, _ = ParseOpenTSDBPut("put sys.cpu 1377447313 x")
+	_, _, _, err = point.Sample(nil)
+	AssertEqual(t, err != nil, true)
+	_, _, _, err = (&OpenTSDBPoint{Metric: "sys cpu", Value: "1"}).Sample(nil)
+	AssertEqual(t, err != nil, true)
+}
+
+func Test_FoldTags(t *testing.T) {
+	tags := map[string]string{"host": "web1.example.com", "dc": "eu", "cpu": "0"}
+	AssertEqual(t, FoldTags("sys.cpu", tags, []string{"dc", "host"}), "sys.cpu.eu.web1_example_com.0")
+	AssertEqual(t, FoldTags("sys.cpu", tags, nil), "sys.cpu.0.eu.web1_example_com")
+	AssertEqual(t, FoldTags("sys.cpu", nil, []string{"host"}), "sys.cpu")
+}
+
+func Test_OpenTSDBIngest(t *testing.T) {
+	server := NewAlmazServer()
+	err := server.ApplyConfig(&Config{DurationInHours: 1, PrecisionInSeconds: 10, OpenTSDBTags: "host"})
+	AssertEqual(t, err, nil)
+
+	// auto-detected on the Carbon port
+	server.processLine("put sys.load 100 2 host=web1", nil)
+	server.processLine("sys.load.web1 3 100", nil)
+	AssertEqual(t, server.storage.metrics["sys.load.web1"].GetValueAt(100), 5)
+
+	body := `[{"metric": "sys.mem", "timestamp": 1377447313000, "value": 4, "tags": {"host": "web1"}},
+		{"metric": "sys.load", "timestamp": 110, "value": "6", "tags": {"host": "web2"}}]`
+	w := httptest.NewRecorder()
+	server.http_opentsdb_put(w, httptest.NewRequest("POST", "/api/put", strings.NewReader(body)))
+	AssertEqual(t, w.Code, 204)
+	AssertEqual(t, server.storage.metrics["sys.mem.web1"].GetValueAt(1377447313), 4)
+	AssertEqual(t, server.storage.metrics["sys.load.web2"].GetValueAt(110), 6)
+
+	w = httptest.NewRecorder()
+	server.http_opentsdb_put(w, httptest.NewRequest("POST", "/api/put", strings.NewReader(`{"metric": "", "value": 1}`)))
+	AssertEqual(t, w.Code, 400)
+	w = httptest.NewRecorder()
+	server.http_opentsdb_put(w, httptest.NewRequest("POST", "/api/put", strings.NewReader(`{"metric": "sys load", "timestamp": 110, "value": 1}`)))
+	AssertEqual(t, w.Code, 400)
+
+	// values are stored as they are, not as formatted Carbon lines
+	server.processLine("put sys.tiny 100 0.0000002 host=web1", nil)
+	AssertEqual(t, server.storage.metrics["sys.tiny.web1"].GetValueAt(100), float64(float32(2e-7)))
+}
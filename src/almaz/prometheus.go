@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prometheus rules select stored metrics for /metrics and map their dotted
+// names to Prometheus names with labels; $N is the N-th * of the pattern:
+//
+//   stats_counts.adv.shows.*.*.* adv_shows_total site=$1 zone=$2 banner=$3
+//
+// The first matching rule wins; metrics matching no rule are not exposed.
+// Metrics mapped to the same series are summed. Names ending with _total
+// are typed as counters, the rest as gauges; names starting with almaz_
+// are reserved for own metrics of almaz.
+
+var (
+	prometheusNameRegex  = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	prometheusLabelRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	prometheusRefRegex   = regexp.MustCompile(`\$\d+`)
+	prometheusEscaper    = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// PrometheusOwnPrefix starts names of own metrics of almaz at /metrics.
+const PrometheusOwnPrefix = "almaz_"
+
+type PrometheusRule struct {
+	Pattern string
+	Name    string
+	Labels  []*PrometheusLabel
+	split   []string
+}
+
+type PrometheusLabel struct {
+	Name  string
+	Value string // may refer to wildcards as $N
+}
+
+func ParsePrometheusRule(line string) (*PrometheusRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("bad prometheus rule %q, expected <pattern> <name> [label=value ...]", line)
+	}
+	rule := &PrometheusRule{Pattern: fields[0], Name: fields[1]}
+	rule.split = strings.Split(rule.Pattern, ".")
+	if !prometheusNameRegex.MatchString(rule.Name) {
+		return nil, fmt.Errorf("bad prometheus rule %q: invalid metric name %s", line, rule.Name)
+	}
+	if strings.HasPrefix(rule.Name, PrometheusOwnPrefix) {
+		return nil, fmt.Errorf("bad prometheus rule %q: names starting with %s are reserved", line, PrometheusOwnPrefix)
+	}
+	for _, field := range fields[2:] {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || !prometheusLabelRegex.MatchString(parts[0]) {
+			return nil, fmt.Errorf("bad prometheus rule %q: invalid label %s", line, field)
+		}
+		rule.Labels = append(rule.Labels, &PrometheusLabel{parts[0], parts[1]})
+	}
+	return rule, nil
+}
+
+func LoadPrometheusRules(path string) ([]*PrometheusRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	rules := make([]*PrometheusRule, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := ParsePrometheusRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// Series returns the Prometheus series for a metric name split by dots,
+// like adv_shows_total{site="429",zone="2005"}, or "" if the rule doesn't match.
+func (self *PrometheusRule) Series(split_name []string) string {
+	if !matchesPattern(split_name, self.split) {
+		return ""
+	}
+	wildcards := make([]string, 0)
+	for i, part := range self.split {
+		if part == "*" {
+			wildcards = append(wildcards, split_name[i])
+		}
+	}
+	if len(self.Labels) == 0 {
+		return self.Name
+	}
+	labels := make([]string, len(self.Labels))
+	for i, label := range self.Labels {
+		value := prometheusRefRegex.ReplaceAllStringFunc(label.Value, func(ref string) string {
+			n, _ := strconv.Atoi(ref[1:])
+			if n < 1 || n > len(wildcards) {
+				return ""
+			}
+			return wildcards[n-1]
+		})
+		labels[i] = label.Name + `="` + prometheusEscaper.Replace(value) + `"`
+	}
+	return self.Name + "{" + strings.Join(labels, ",") + "}"
+}
+
+// prometheusType is the metric type of a series name mapped by the rules.
+func prometheusType(name string) string {
+	if strings.HasSuffix(name, "_total") {
+		return "counter"
+	}
+	return "gauge"
+}
+
+// PrometheusSeries maps stored metrics to Prometheus series. Values are
+// sums over the last `window` seconds before now, or values of the last
+// complete bucket if window is 0.
+func (self *Storage) PrometheusSeries(rules []*PrometheusRule, now int64, window int64) map[string]float64 {
+	self.RLock()
+	defer self.RUnlock()
+	series := make(map[string]float64)
+	if len(rules) == 0 {
+		return series
+	}
+	for _, m := range self.metrics {
+		for _, rule := range rules {
+			name := rule.Series(m.splitName)
+			if name == "" {
+				continue
+			}
+			if window > 0 {
+				series[name] += m.GetSumForLastNSeconds(window, now)
+			} else {
+				series[name] += m.GetValueAt(now - int64(m.dt))
+			}
+			break
+		}
+	}
+	return series
+}
+
+// WritePrometheus writes series in the Prometheus text format,
+// grouped by metric name, with metric_type for each name.
+func WritePrometheus(buf *bytes.Buffer, series map[string]float64, metric_type func(name string) string) {
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	last_name := ""
+	for _, key := range keys {
+		name := key
+		if i := strings.Index(key, "{"); i >= 0 {
+			name = key[:i]
+		}
+		if name != last_name {
+			fmt.Fprintf(buf, "# TYPE %s %s\n", name, metric_type(name))
+			last_name = name
+		}
+		fmt.Fprintf(buf, "%s %s\n", key, strconv.FormatFloat(series[key], 'g', -1, 64))
+	}
+}
+
+func (self *AlmazServer) http_prometheus_metrics(w http.ResponseWriter, r *http.Request) {
+	p := self.pipeline()
+	series := self.storage.PrometheusSeries(p.prometheus_rules, time.Now().Unix(), int64(p.config.PrometheusWindow))
+
+	var buf bytes.Buffer
+	WritePrometheus(&buf, series, prometheusType)
+
+	own := make(map[string]float64)
+	types := make(map[string]string)
+	for _, stat := range self.SelfStats() {
+		name := PrometheusOwnPrefix + stat.Name
+		types[name] = "gauge"
+		if stat.Counter {
+			name += "_total"
+			types[name] = "counter"
+		}
+		own[name] = stat.Value
+	}
+	WritePrometheus(&buf, own, func(name string) string { return types[name] })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
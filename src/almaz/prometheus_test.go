@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_PrometheusRuleSeries(t *testing.T) {
+	rule, err := ParsePrometheusRule(`stats_counts.adv.shows.*.*.* adv_shows_total site=$1 zone=$2 banner=$3`)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, rule.Series([]string{"stats_counts", "adv", "shows", "429", "2005", "4186"}),
+		`adv_shows_total{site="429",zone="2005",banner="4186"}`)
+	AssertEqual(t, rule.Series([]string{"stats_counts", "adv", "clicks", "429", "2005", "4186"}), "")
+
+	rule, err = ParsePrometheusRule(`servers.* load server=$1-"x" extra=$5`)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, rule.Series([]string{"servers", `web\1`}), `load{server="web\\1-\"x\"",extra=""}`)
+
+	for _, line := range []string{"a.*", "a.* 1abc", "a.* name site", "a.* name 1a=b", "a.* almaz_queries_total"} {
+		_, err := ParsePrometheusRule(line)
+		AssertEqual(t, err != nil, true)
+	}
+}
+
+func Test_PrometheusExposition(t *testing.T) {
+	s := NewStorage()
+	s.SetStorageParams(1, 10)
+	s.StoreMetric("stats.shows.web1.a", 1, 100)
+	s.StoreMetric("stats.shows.web1.b", 2, 100)
+	s.StoreMetric("stats.shows.web2.a", 4, 100)
+	s.StoreMetric("stats.shows.web2.a", 8, 110)
+	s.StoreMetric("stats.other", 16, 100)
+
+	rules := make([]*PrometheusRule, 0)
+	for _, line := range []string{
+		`stats.shows.*.* shows_total server=$1`,
+		`stats.* stats`,
+	} {
+		rule, err := ParsePrometheusRule(line)
+		AssertEqual(t, err, nil)
+		rules = append(rules, rule)
+	}
+
+	var buf bytes.Buffer
+	WritePrometheus(&buf, s.PrometheusSeries(rules, 115, 0), prometheusType)
+	AssertEqual(t, buf.String(), "# TYPE shows_total counter\n"+
+		"shows_total{server=\"web1\"} 3\n"+
+		"shows_total{server=\"web2\"} 4\n"+
+		"# TYPE stats gauge\n"+
+		"stats 16\n")
+
+	buf.Reset()
+	WritePrometheus(&buf, s.PrometheusSeries(rules, 115, 60), prometheusType)
+	AssertEqual(t, buf.String(), "# TYPE shows_total counter\n"+
+		"shows_total{server=\"web1\"} 3\n"+
+		"shows_total{server=\"web2\"} 12\n"+
+		"# TYPE stats gauge\n"+
+		"stats 16\n")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// PruneRule sets how long metrics matching Pattern are kept after their
+// last sample, e.g.
+//
+//	^stats\.deploys\. 604800
+//	^servers\.tmp- 3600
+type PruneRule struct {
+	Pattern *regexp.Regexp
+	TTL     int64 // seconds
+}
+
+func ParsePruneRule(line string) (*PruneRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("bad prune rule %q, expected <regex> <ttl-seconds>", line)
+	}
+	rx, err := regexp.Compile(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("bad prune rule %q: %s", line, err)
+	}
+	ttl, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || ttl <= 0 {
+		return nil, fmt.Errorf("bad prune rule %q: ttl must be a positive number of seconds", line)
+	}
+	return &PruneRule{rx, ttl}, nil
+}
+
+func LoadPruneRules(path string) ([]*PruneRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	rules := make([]*PruneRule, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := ParsePruneRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// IdleTTL returns how long the metric is kept after its last sample:
+// the first matching prune rule, or --prune-ttl, or the retention.
+func (self *Pipeline) IdleTTL(metric string) int64 {
+	for _, rule := range self.prune_rules {
+		if rule.Pattern.MatchString(metric) {
+			return rule.TTL
+		}
+	}
+	if self.config.PruneTTL > 0 {
+		return int64(self.config.PruneTTL)
+	}
+	return int64(self.config.DurationInHours) * 60 * 60
+}
+
+// IsIdle tells whether the metric got no samples for ttl seconds before now.
+func (self *Metric) IsIdle(ttl int64, now int64) bool {
+	return self.Age()+int64(self.dt)+ttl <= now
+}
+
+// PruneIdle removes metrics idle for longer than their TTL. Candidates are
+// found under the read lock, so ingest goes on meanwhile; they are checked
+// again under the write lock, which is held only to remove them.
+func (self *Storage) PruneIdle(now int64, ttl func(metric string) int64) []string {
+	candidates := make([]string, 0)
+	self.RLock()
+	for name, metric := range self.metrics {
+		if metric.IsIdle(ttl(name), now) {
+			candidates = append(candidates, name)
+		}
+	}
+	self.RUnlock()
+	if len(candidates) == 0 {
+		return candidates
+	}
+
+	pruned := make([]string, 0, len(candidates))
+	self.Lock()
+	defer self.Unlock()
+	for _, name := range candidates {
+		metric, ok := self.metrics[name]
+		if ok && metric.IsIdle(ttl(name), now) {
+			delete(self.metrics, name)
+			self.unindexTags(name)
+			pruned = append(pruned, name)
+		}
+	}
+	return pruned
+}
+
+func (self *AlmazServer) AuditLoop() {
+	for {
+		interval := self.config().PruneInterval
+		if interval <= 0 {
+			interval = 60
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+		if !self.config().Audit {
+			continue
+		}
+		self.PruneOld()
+		log.Printf("Audit: metric number = %d", self.storage.MetricCount())
+	}
+}
+
+func (self *AlmazServer) PruneOld() {
+	p := self.pipeline()
+	pruned := self.storage.PruneIdle(time.Now().Unix(), p.IdleTTL)
+	if len(pruned) > 0 {
+		log.Printf("%d idle metrics pruned", len(pruned))
+		atomic.AddInt64(&self.counters.pruned, int64(len(pruned)))
+		self.limiter.Recount(self.storage.Metrics())
+	}
+}
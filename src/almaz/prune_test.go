@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"testing"
+)
+
+func Test_PruneIdle(t *testing.T) {
+	server := NewAlmazServer()
+	err := server.ApplyConfig(&Config{
+		DurationInHours:    1,
+		PrecisionInSeconds: 10,
+		Prune:              []string{`^tmp\. 60`},
+	})
+	AssertEqual(t, err, nil)
+	p := server.pipeline()
+	AssertEqual(t, p.IdleTTL("tmp.a"), int64(60))
+	AssertEqual(t, p.IdleTTL("stats.a"), int64(3600))
+
+	s := server.storage
+	s.StoreMetric("stats.recent", 1, 10000)
+	s.StoreMetric("stats.quiet", 1, 7000) // still has data within retention
+	s.StoreMetric("stats.gone", 1, 6390)  // last bucket 6390-6399 is out of retention
+	s.StoreMetric("tmp.recent", 1, 9950)
+	s.StoreMetric("tmp.gone", 1, 9920)
+
+	pruned := s.PruneIdle(10000, p.IdleTTL)
+	sort.Strings(pruned)
+	AssertEqual(t, pruned, []string{"stats.gone", "tmp.gone"})
+	AssertEqual(t, s.MetricCount(), 3)
+	AssertEqual(t, s.HasMetric("stats.quiet"), true)
+
+	AssertEqual(t, len(s.PruneIdle(10000, p.IdleTTL)), 0)
+}
+
+func Test_PruneDuringIngest(t *testing.T) {
+	s := NewStorage()
+	s.SetStorageParams(1, 10)
+	ttl := func(string) int64 { return 60 }
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			s.StoreMetric("busy", 1, 10000)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		s.StoreMetric("idle", 1, 100)
+		s.PruneIdle(10000, ttl)
+	}
+	wg.Wait()
+	AssertEqual(t, s.HasMetric("idle"), false)
+	AssertEqual(t, s.metrics["busy"].GetValueAt(10000), 1000)
+}
+
+func Test_ParsePruneRuleErrors(t *testing.T) {
+	for _, line := range []string{"^a", "^a 0", "^a 1h", "^(a 60"} {
+		_, err := ParsePruneRule(line)
+		AssertEqual(t, err != nil, true)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	RingReplicaCount = 100
+
+	RelayModeConsistentHashing = "consistent-hashing"
+	RelayModeAll               = "all"
+
+	// RelayRetireDelay is how long forwarders removed by a reload keep
+	// accepting lines: the ingest path may still route a line through
+	// the previous pipeline right after the new one is installed.
+	RelayRetireDelay = time.Second
+)
+
+// HashRing is a port of carbon's ConsistentHashRing (carbon/hashing.py,
+// carbon_ch hash type), so that almaz and carbon-relay with the same
+// destinations send every metric to the same place.
+type HashRing struct {
+	entries []ringEntry
+	nodes   int
+}
+
+type ringEntry struct {
+	position int
+	node     int
+}
+
+func ringPosition(key string) int {
+	sum := md5.Sum([]byte(key))
+	return int(binary.BigEndian.Uint16(sum[:2]))
+}
+
+// NewHashRing builds a ring of nodes identified by their carbon keys (see RingKey).
+func NewHashRing(keys []string) *HashRing {
+	ring := &HashRing{}
+	ring.nodes = len(keys)
+	taken := make(map[int]bool)
+	for node, key := range keys {
+		for i := 0; i < RingReplicaCount; i++ {
+			position := ringPosition(fmt.Sprintf("%s:%d", key, i))
+			for taken[position] {
+				position++
+			}
+			taken[position] = true
+			ring.entries = append(ring.entries, ringEntry{position, node})
+		}
+	}
+	sort.Slice(ring.entries, func(i, j int) bool {
+		return ring.entries[i].position < ring.entries[j].position
+	})
+	return ring
+}
+
+// RingKey formats a destination the way carbon does: str((server, instance)).
+func RingKey(server string, instance string) string {
+	if instance == "" {
+		return fmt.Sprintf("('%s', None)", server)
+	}
+	return fmt.Sprintf("('%s', '%s')", server, instance)
+}
+
+// GetNodes returns up to n distinct nodes responsible for the key, in ring order.
+func (self *HashRing) GetNodes(key string, n int) []int {
+	if n > self.nodes {
+		n = self.nodes
+	}
+	nodes := make([]int, 0, n)
+	if n == 0 {
+		return nodes
+	}
+	if self.nodes == 1 {
+		return append(nodes, self.entries[0].node)
+	}
+	position := ringPosition(key)
+	index := sort.Search(len(self.entries), func(i int) bool {
+		return self.entries[i].position >= position
+	})
+	seen := make(map[int]bool)
+	for i := 0; i < len(self.entries) && len(nodes) < n; i++ {
+		node := self.entries[(index+i)%len(self.entries)].node
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// Relay distributes forwarded lines between destinations, like carbon-relay.
+type Relay struct {
+	forwarders  []*Forwarder
+	ring        *HashRing
+	mode        string
+	replication int
+	filter      *regexp.Regexp
+}
+
+type RelayParams struct {
+	Destinations []string // host:port[:instance]
+	Mode         string
+	Replication  int
+	Filter       string // forward only metrics matching the regex, if set
+	QueueSize    int
+	BatchSize    int
+	SpoolDir     string // spill lines which don't fit into the queue to disk, if set
+	SpoolBytes   int64  // per destination
+}
+
+// NewRelay creates a relay; forwarders of the previous relay, if any, are reused
+// for destinations with the same address, so that their queues and spools
+// carry over. Such forwarders keep their queue and spool settings.
+func NewRelay(params *RelayParams, previous *Relay) (*Relay, error) {
+	relay := &Relay{}
+	relay.mode = params.Mode
+	relay.replication = params.Replication
+	if relay.mode != RelayModeConsistentHashing && relay.mode != RelayModeAll {
+		return nil, fmt.Errorf("unknown relay mode %s", relay.mode)
+	}
+	if relay.replication < 1 {
+		return nil, fmt.Errorf("replication factor must be at least 1")
+	}
+	if params.Filter != "" {
+		rx, err := regexp.Compile(params.Filter)
+		if err != nil {
+			return nil, err
+		}
+		relay.filter = rx
+	}
+
+	keys := make([]string, 0, len(params.Destinations))
+	for _, destination := range params.Destinations {
+		address, key, err := ParseDestination(destination)
+		if err != nil {
+			return nil, err
+		}
+		forwarder := previous.forwarderFor(address)
+		if forwarder != nil {
+			relay.forwarders = append(relay.forwarders, forwarder)
+			keys = append(keys, key)
+			continue
+		}
+		forwarder = NewForwarder(address, params.QueueSize, params.BatchSize)
+		if params.SpoolDir != "" {
+			dir := filepath.Join(params.SpoolDir, strings.Replace(address, ":", "_", -1))
+			spool, err := OpenSpool(dir, params.SpoolBytes, SpoolSegmentBytes)
+			if err != nil {
+				return nil, err
+			}
+			forwarder.SetSpool(spool)
+		}
+		relay.forwarders = append(relay.forwarders, forwarder)
+		keys = append(keys, key)
+	}
+	if len(relay.forwarders) == 0 {
+		return nil, fmt.Errorf("no destinations")
+	}
+	relay.ring = NewHashRing(keys)
+	return relay, nil
+}
+
+// ParseDestination splits carbon-style host:port[:instance] into
+// the address to dial and the key on the hash ring.
+func ParseDestination(destination string) (string, string, error) {
+	parts := strings.Split(strings.TrimSpace(destination), ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("bad destination %q, expected host:port[:instance]", destination)
+	}
+	instance := ""
+	if len(parts) == 3 {
+		instance = parts[2]
+	}
+	return net.JoinHostPort(parts[0], parts[1]), RingKey(parts[0], instance), nil
+}
+
+func (self *Relay) forwarderFor(address string) *Forwarder {
+	if self == nil {
+		return nil
+	}
+	for _, f := range self.forwarders {
+		if f.address == address {
+			return f
+		}
+	}
+	return nil
+}
+
+// Start starts forwarders which are not running yet.
+func (self *Relay) Start(previous *Relay) {
+	for _, f := range self.forwarders {
+		if previous.forwarderFor(f.address) == nil {
+			f.Start()
+		}
+	}
+}
+
+// Retire stops forwarders which the next relay doesn't use, after
+// RelayRetireDelay; they send what is queued before disconnecting.
+func (self *Relay) Retire(next *Relay) {
+	for _, f := range self.forwarders {
+		if next.forwarderFor(f.address) == nil {
+			time.AfterFunc(RelayRetireDelay, f.Stop)
+		}
+	}
+}
+
+// Destinations returns indexes of forwarders the metric should be sent to.
+func (self *Relay) Destinations(metric string) []int {
+	if self.filter != nil && !self.filter.MatchString(metric) {
+		return nil
+	}
+	if self.mode == RelayModeAll {
+		all := make([]int, len(self.forwarders))
+		for i := range all {
+			all[i] = i
+		}
+		return all
+	}
+	return self.ring.GetNodes(metric, self.replication)
+}
+
+// Route forwards a Carbon protocol line to its destinations.
+func (self *Relay) Route(line string) {
+	metric := line
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		metric = line[:i]
+	}
+	for _, i := range self.Destinations(metric) {
+		self.forwarders[i].Enqueue(line)
+	}
+}
+
+func (self *Relay) Stats() []*ForwarderStats {
+	stats := make([]*ForwarderStats, len(self.forwarders))
+	for i, f := range self.forwarders {
+		stats[i] = f.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_HashRingMatchesCarbon(t *testing.T) {
+	// expected nodes were computed with carbon's ConsistentHashRing
+	// for destinations 127.0.0.1:2004:a, 127.0.0.1:2104:b, 10.0.0.5:2004
+	ring := NewHashRing([]string{
+		RingKey("127.0.0.1", "a"),
+		RingKey("127.0.0.1", "b"),
+		RingKey("10.0.0.5", ""),
+	})
+	AssertEqual(t, ring.GetNodes("stats.shows.all", 3), []int{1, 0, 2})
+	AssertEqual(t, ring.GetNodes("a.b.c", 3), []int{0, 2, 1})
+	AssertEqual(t, ring.GetNodes("stats_counts.adv.shows.429.2005.4186", 3), []int{0, 2, 1})
+	AssertEqual(t, ring.GetNodes("statsd.numStats", 3), []int{2, 0, 1})
+	AssertEqual(t, ring.GetNodes("statsd.numStats", 1), []int{2})
+	AssertEqual(t, ring.GetNodes("statsd.numStats", 5), []int{2, 0, 1})
+
+	single := NewHashRing([]string{RingKey("127.0.0.1", "")})
+	AssertEqual(t, single.GetNodes("anything", 2), []int{0})
+}
+
+func Test_ParseDestination(t *testing.T) {
+	address, key, err := ParseDestination("127.0.0.1:2004:a")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, address, "127.0.0.1:2004")
+	AssertEqual(t, key, "('127.0.0.1', 'a')")
+
+	address, key, err = ParseDestination(" graphite:2003")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, address, "graphite:2003")
+	AssertEqual(t, key, "('graphite', None)")
+
+	_, _, err = ParseDestination("graphite")
+	AssertEqual(t, err != nil, true)
+}
+
+func Test_RelayDestinations(t *testing.T) {
+	params := &RelayParams{
+		Destinations: []string{"127.0.0.1:2004:a", "127.0.0.1:2104:b", "10.0.0.5:2004"},
+		Mode:         RelayModeConsistentHashing,
+		Replication:  2,
+		QueueSize:    10,
+		BatchSize:    10,
+	}
+	relay, err := NewRelay(params, nil)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, relay.Destinations("stats.shows.all"), []int{1, 0})
+
+	params.Mode = RelayModeAll
+	params.Filter = `^stats\.`
+	relay, err = NewRelay(params, nil)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, relay.Destinations("stats.shows.all"), []int{0, 1, 2})
+	AssertEqual(t, len(relay.Destinations("statsd.numStats")), 0)
+
+	relay.Route("stats.shows.all 1 1377447313")
+	relay.Route("statsd.numStats 1 1377447313")
+	for _, stats := range relay.Stats() {
+		AssertEqual(t, stats.Queued, 1)
+	}
+
+	params.Mode = "random"
+	_, err = NewRelay(params, nil)
+	AssertEqual(t, err != nil, true)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync/atomic"
+)
+
+// Prometheus remote_write receiver: a POST with a snappy-compressed
+// protobuf WriteRequest. Only the fields almaz needs are decoded:
+//
+//   message WriteRequest { repeated TimeSeries timeseries = 1; ... }
+//   message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; ... }
+//   message Label { string name = 1; string value = 2; }
+//   message Sample { double value = 1; int64 timestamp = 2; } // in ms
+//
+// Series are named by --remote-write-template (see ExpandNameTemplate),
+// e.g. prometheus.{job}.{instance}.{__name__}.
+
+// RemoteWriteMaxBytes limits the size of a compressed request.
+const RemoteWriteMaxBytes = 32 << 20
+
+var ErrCorruptProtobuf = errors.New("protobuf: corrupt input")
+
+type RemoteWriteSeries struct {
+	Labels  map[string]string
+	Samples []RemoteWriteSample
+}
+
+type RemoteWriteSample struct {
+	Value     float64
+	Timestamp int64 // ms
+}
+
+// protoReader reads fields of a protobuf message.
+type protoReader struct {
+	data []byte
+}
+
+func (self *protoReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(self.data)
+	if n <= 0 {
+		return 0, ErrCorruptProtobuf
+	}
+	self.data = self.data[n:]
+	return v, nil
+}
+
+// next returns the number of the next field and, for length-delimited
+// fields, their contents; varint and fixed64 fields are returned as value.
+func (self *protoReader) next() (field int, value uint64, bytes []byte, err error) {
+	key, err := self.varint()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	field = int(key >> 3)
+	switch key & 7 {
+	case 0:
+		value, err = self.varint()
+	case 1:
+		if len(self.data) < 8 {
+			return 0, 0, nil, ErrCorruptProtobuf
+		}
+		value = binary.LittleEndian.Uint64(self.data)
+		self.data = self.data[8:]
+	case 2:
+		var length uint64
+		length, err = self.varint()
+		if err == nil && length > uint64(len(self.data)) {
+			err = ErrCorruptProtobuf
+		}
+		if err == nil {
+			bytes = self.data[:length]
+			self.data = self.data[length:]
+		}
+	case 5:
+		if len(self.data) < 4 {
+			return 0, 0, nil, ErrCorruptProtobuf
+		}
+		value = uint64(binary.LittleEndian.Uint32(self.data))
+		self.data = self.data[4:]
+	default:
+		err = ErrCorruptProtobuf
+	}
+	return field, value, bytes, err
+}
+
+func (self *protoReader) done() bool {
+	return len(self.data) == 0
+}
+
+// ParseWriteRequest decodes a (decompressed) remote_write WriteRequest.
+func ParseWriteRequest(data []byte) ([]*RemoteWriteSeries, error) {
+	result := make([]*RemoteWriteSeries, 0)
+	r := &protoReader{data}
+	for !r.done() {
+		field, _, bytes, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if field != 1 {
+			continue
+		}
+		series, err := parseTimeSeries(bytes)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, series)
+	}
+	return result, nil
+}
+
+func parseTimeSeries(data []byte) (*RemoteWriteSeries, error) {
+	series := &RemoteWriteSeries{Labels: make(map[string]string)}
+	r := &protoReader{data}
+	for !r.done() {
+		field, _, bytes, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			name, value, err := parseLabel(bytes)
+			if err != nil {
+				return nil, err
+			}
+			series.Labels[name] = value
+		case 2:
+			sample, err := parseSample(bytes)
+			if err != nil {
+				return nil, err
+			}
+			series.Samples = append(series.Samples, sample)
+		}
+	}
+	return series, nil
+}
+
+func parseLabel(data []byte) (string, string, error) {
+	var name, value string
+	r := &protoReader{data}
+	for !r.done() {
+		field, _, bytes, err := r.next()
+		if err != nil {
+			return "", "", err
+		}
+		switch field {
+		case 1:
+			name = string(bytes)
+		case 2:
+			value = string(bytes)
+		}
+	}
+	return name, value, nil
+}
+
+func parseSample(data []byte) (RemoteWriteSample, error) {
+	var sample RemoteWriteSample
+	r := &protoReader{data}
+	for !r.done() {
+		field, value, _, err := r.next()
+		if err != nil {
+			return sample, err
+		}
+		switch field {
+		case 1:
+			sample.Value = math.Float64frombits(value)
+		case 2:
+			sample.Timestamp = int64(value)
+		}
+	}
+	return sample, nil
+}
+
+func (self *AlmazServer) http_remote_write(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "use POST method", 405)
+		return
+	}
+	defer r.Body.Close()
+	compressed, ok, err := readIngestBody(r, RemoteWriteMaxBytes)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error while reading request: %s", err), 400)
+		return
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("request is larger than %d bytes", RemoteWriteMaxBytes), 413)
+		return
+	}
+	sender := self.NewSender(r.RemoteAddr, r.TLS)
+	data, err := SnappyDecode(compressed)
+	if err != nil {
+		self.senders.Seen(sender, 0, len(compressed))
+		self.senders.Failed(sender, "", err)
+		http.Error(w, fmt.Sprintf("error while decompressing request: %s", err), 400)
+		return
+	}
+	series, err := ParseWriteRequest(data)
+	if err != nil {
+		self.senders.Seen(sender, 0, len(compressed))
+		self.senders.Failed(sender, "", err)
+		http.Error(w, fmt.Sprintf("error while decoding request: %s", err), 400)
+		return
+	}
+	samples := 0
+	for _, s := range series {
+		samples += len(s.Samples)
+	}
+	self.senders.Seen(sender, samples, len(compressed))
+
+	template := self.config().RemoteWriteTemplate
+	metric_updates := make([]*MetricUpdate, 0)
+	for _, s := range series {
+		name, ok := ExpandNameTemplate(template, s.Labels)
+		if !ok {
+			atomic.AddInt64(&self.counters.rejected, int64(len(s.Samples)))
+			continue
+		}
+		for _, sample := range s.Samples {
+			if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+				continue // NaN marks stale series
+			}
+			metric_updates, _ = self.ingestValue(sender, name, sample.Value, sample.Timestamp/1000, metric_updates)
+		}
+	}
+	go self.PushUpstream(metric_updates)
+	w.WriteHeader(http.StatusNoContent)
+}
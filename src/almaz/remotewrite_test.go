@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func protoBytes(buf []byte, field int, data []byte) []byte {
+	buf = appendUvarint(buf, uint64(field<<3|2))
+	buf = appendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func protoSample(value float64, ts_ms int64) []byte {
+	buf := appendUvarint(nil, 1<<3|1)
+	var fixed [8]byte
+	binary.LittleEndian.PutUint64(fixed[:], math.Float64bits(value))
+	buf = append(buf, fixed[:]...)
+	buf = appendUvarint(buf, 2<<3|0)
+	return appendUvarint(buf, uint64(ts_ms))
+}
+
+func protoTimeSeries(labels [][2]string, samples ...[]byte) []byte {
+	var buf []byte
+	for _, label := range labels {
+		var l []byte
+		l = protoBytes(l, 1, []byte(label[0]))
+		l = protoBytes(l, 2, []byte(label[1]))
+		buf = protoBytes(buf, 1, l)
+	}
+	for _, sample := range samples {
+		buf = protoBytes(buf, 2, sample)
+	}
+	// exemplars are skipped
+	return protoBytes(buf, 3, []byte{})
+}
+
+func testWriteRequest() []byte {
+	var req []byte
+	req = protoBytes(req, 1, protoTimeSeries(
+		[][2]string{{"__name__", "http_requests_total"}, {"job", "api"}, {"instance", "web1.example.com:9090"}},
+		protoSample(5, 100000),
+		protoSample(7, 110500),
+	))
+	req = protoBytes(req, 1, protoTimeSeries(
+		[][2]string{{"__name__", "up"}},
+		protoSample(1, 100000),
+	))
+	return req
+}
+
+func Test_ParseWriteRequest(t *testing.T) {
+	series, err := ParseWriteRequest(testWriteRequest())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(series), 2)
+	AssertEqual(t, series[0].Labels["instance"], "web1.example.com:9090")
+	AssertEqual(t, series[0].Samples, []RemoteWriteSample{{5, 100000}, {7, 110500}})
+	AssertEqual(t, series[1].Labels, map[string]string{"__name__": "up"})
+
+	_, err = ParseWriteRequest([]byte{1<<3 | 2, 10, 1})
+	AssertEqual(t, err, ErrCorruptProtobuf)
+}
+
+func Test_RemoteWriteHandler(t *testing.T) {
+	server := NewAlmazServer()
+	err := server.ApplyConfig(&Config{
+		DurationInHours:     1,
+		PrecisionInSeconds:  10,
+		RemoteWriteTemplate: "prom.{job}.{__name__}",
+	})
+	AssertEqual(t, err, nil)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(snappyLiteral(testWriteRequest())))
+	server.http_remote_write(w, r)
+	AssertEqual(t, w.Code, http.StatusNoContent)
+	AssertEqual(t, server.storage.MetricCount(), 1)
+	metric := server.storage.metrics["prom.api.http_requests_total"]
+	AssertEqual(t, metric.GetValueAt(100), 5)
+	AssertEqual(t, metric.GetValueAt(110), 7)
+	AssertEqual(t, server.SelfStats()[2].Value, float64(1)) // "up" has no job label
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(testWriteRequest()))
+	server.http_remote_write(w, r)
+	AssertEqual(t, w.Code, 400)
+
+	// values are stored as they are, not as formatted Carbon lines
+	req := protoBytes(nil, 1, protoTimeSeries(
+		[][2]string{{"__name__", "latency_seconds"}, {"job", "api"}},
+		protoSample(2e-7, 100000),
+	))
+	w = httptest.NewRecorder()
+	server.http_remote_write(w, httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(snappyLiteral(req))))
+	AssertEqual(t, w.Code, http.StatusNoContent)
+	AssertEqual(t, server.storage.metrics["prom.api.latency_seconds"].GetValueAt(100), float64(float32(2e-7)))
+
+	w = httptest.NewRecorder()
+	server.http_remote_write(w, httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(make([]byte, RemoteWriteMaxBytes+1))))
+	AssertEqual(t, w.Code, 413)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Rewrite rules normalize metric names at ingest, before the acceptance
+// check. Rules are applied in order, one per line:
+//
+//   rename ^stats_counts\.(.*)$ stats.$1
+//   copy   ^servers\.([^.]+)\.(.*)$ servers.all.$2
+//   drop   ^test\.
+//
+// rename changes the name seen by the following rules; drop discards the
+// metric and stops; copy additionally stores and forwards the metric under
+// the replacement name, which is not rewritten any further.
+
+const (
+	RewriteRename = "rename"
+	RewriteCopy   = "copy"
+	RewriteDrop   = "drop"
+)
+
+type RewriteRule struct {
+	Action      string
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+type RewriteRules []*RewriteRule
+
+type RewriteStep struct {
+	Rule    string `json:"rule"`
+	Name    string `json:"name"`
+	Copy    string `json:"copy,omitempty"`
+	Dropped bool   `json:"dropped,omitempty"`
+}
+
+func ParseRewriteRule(line string) (*RewriteRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty rewrite rule")
+	}
+	rule := &RewriteRule{Action: fields[0]}
+	switch {
+	case rule.Action == RewriteDrop && len(fields) == 2:
+	case (rule.Action == RewriteRename || rule.Action == RewriteCopy) && len(fields) == 3:
+		rule.Replacement = fields[2]
+	default:
+		return nil, fmt.Errorf("bad rewrite rule %q, expected rename|copy <regex> <replacement> or drop <regex>", line)
+	}
+	rx, err := regexp.Compile(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("bad rewrite rule %q: %s", line, err)
+	}
+	rule.Pattern = rx
+	return rule, nil
+}
+
+func (self *RewriteRule) String() string {
+	if self.Action == RewriteDrop {
+		return self.Action + " " + self.Pattern.String()
+	}
+	return self.Action + " " + self.Pattern.String() + " " + self.Replacement
+}
+
+func LoadRewriteRules(path string) (RewriteRules, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	rules := make(RewriteRules, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := ParseRewriteRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// Rewrite returns the names a metric is stored and forwarded under:
+// the rewritten name, unless dropped, followed by copies.
+func (self RewriteRules) Rewrite(name string) []string {
+	names, _ := self.apply(name, false)
+	return names
+}
+
+// Trace is Rewrite which also reports every rule that matched.
+func (self RewriteRules) Trace(name string) ([]string, []*RewriteStep) {
+	return self.apply(name, true)
+}
+
+func (self RewriteRules) apply(name string, trace bool) ([]string, []*RewriteStep) {
+	if len(self) == 0 {
+		return []string{name}, nil
+	}
+	copies := make([]string, 0)
+	var steps []*RewriteStep
+	for _, rule := range self {
+		if !rule.Pattern.MatchString(name) {
+			continue
+		}
+		step := &RewriteStep{Rule: rule.String()}
+		switch rule.Action {
+		case RewriteRename:
+			name = rule.Pattern.ReplaceAllString(name, rule.Replacement)
+		case RewriteCopy:
+			step.Copy = rule.Pattern.ReplaceAllString(name, rule.Replacement)
+			copies = append(copies, step.Copy)
+		case RewriteDrop:
+			step.Dropped = true
+		}
+		step.Name = name
+		if trace {
+			steps = append(steps, step)
+		}
+		if step.Dropped {
+			return copies, steps
+		}
+	}
+	return append([]string{name}, copies...), steps
+}
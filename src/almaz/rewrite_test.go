@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+)
+
+func parseRewriteRules(t *testing.T, lines ...string) RewriteRules {
+	rules := make(RewriteRules, 0)
+	for _, line := range lines {
+		rule, err := ParseRewriteRule(line)
+		AssertEqual(t, err, nil)
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func Test_RewriteRules(t *testing.T) {
+	rules := parseRewriteRules(t,
+		`rename ^stats_counts\.(.*)$ stats.$1`,
+		`rename ^servers\.web1\.example\.com\. servers.web1_example_com.`,
+		`drop ^stats\.test\.`,
+		`copy ^servers\.[^.]+\.(.*)$ servers.all.$1`,
+	)
+	AssertEqual(t, rules.Rewrite("stats_counts.adv.shows"), []string{"stats.adv.shows"})
+	AssertEqual(t, rules.Rewrite("stats_counts.test.x"), []string{})
+	AssertEqual(t, rules.Rewrite("servers.web1.example.com.load"),
+		[]string{"servers.web1_example_com.load", "servers.all.load"})
+	AssertEqual(t, rules.Rewrite("other.metric"), []string{"other.metric"})
+
+	names, steps := rules.Trace("stats_counts.test.x")
+	AssertEqual(t, len(names), 0)
+	AssertEqual(t, len(steps), 2)
+	AssertEqual(t, steps[0].Name, "stats.test.x")
+	AssertEqual(t, steps[1].Rule, `drop ^stats\.test\.`)
+	AssertEqual(t, steps[1].Dropped, true)
+
+	var no_rules RewriteRules
+	AssertEqual(t, no_rules.Rewrite("a.b"), []string{"a.b"})
+}
+
+func Test_ParseRewriteRuleErrors(t *testing.T) {
+	for _, line := range []string{
+		"rename ^a",
+		"drop ^a b",
+		"move ^a b",
+		"rename ^(a b",
+	} {
+		_, err := ParseRewriteRule(line)
+		AssertEqual(t, err != nil, true)
+	}
+}
+
+func Test_ProcessLineRewrites(t *testing.T) {
+	server := NewAlmazServer()
+	err := server.ApplyConfig(&Config{
+		DurationInHours:    1,
+		PrecisionInSeconds: 10,
+		Rewrite: []string{
+			`rename ^stats_counts\.(.*)$ stats.$1`,
+			`copy ^stats\.shows\.(.*)$ stats.all.$1`,
+		},
+		Filter: []string{`allow ^stats\.shows\.`},
+	})
+	AssertEqual(t, err, nil)
+
+	updates := server.processLine("stats_counts.shows.a 2 100", nil)
+	AssertEqual(t, len(updates), 1)
+	AssertEqual(t, updates[0].Metric, "stats.shows.a")
+	AssertEqual(t, server.storage.MetricCount(), 1)
+	AssertEqual(t, server.storage.metrics["stats.shows.a"].GetValueAt(100), 2)
+}
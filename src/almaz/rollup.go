@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// In rollup mode almaz forwards each metric once per bucket, when the bucket
+// closes, instead of every raw line, like carbon-aggregator does.
+// Rollup rules additionally produce summary metrics out of groups of metrics:
+//
+//   stats.shows.all = sum(stats.shows.*)
+//
+// Methods are sum, avg, min, max and count; only metrics with a non-zero
+// value in the bucket take part, since almaz doesn't tell zeros from gaps.
+
+var rollupRuleRegex = regexp.MustCompile(`^\s*(\S+)\s*=\s*(sum|avg|min|max|count)\(\s*(\S+?)\s*\)\s*$`)
+
+type RollupRule struct {
+	Target  string
+	Method  string
+	Pattern string
+	split   []string
+}
+
+func ParseRollupRule(line string) (*RollupRule, error) {
+	m := rollupRuleRegex.FindStringSubmatch(line)
+	if m == nil {
+		return nil, fmt.Errorf("bad rollup rule %q, expected target = method(pattern)", line)
+	}
+	rule := &RollupRule{Target: m[1], Method: m[2], Pattern: m[3]}
+	rule.split = strings.Split(rule.Pattern, ".")
+	return rule, nil
+}
+
+// LoadRollupRules reads rules from a file, one per line; empty lines and
+// lines starting with # are ignored.
+func LoadRollupRules(path string) ([]*RollupRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	rules := make([]*RollupRule, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := ParseRollupRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+type rollupAccumulator struct {
+	sum, min, max float64
+	count         int
+}
+
+func (self *rollupAccumulator) add(value float64) {
+	if self.count == 0 || value < self.min {
+		self.min = value
+	}
+	if self.count == 0 || value > self.max {
+		self.max = value
+	}
+	self.sum += value
+	self.count++
+}
+
+func (self *rollupAccumulator) result(method string) float64 {
+	switch method {
+	case "avg":
+		return self.sum / float64(self.count)
+	case "min":
+		return self.min
+	case "max":
+		return self.max
+	case "count":
+		return float64(self.count)
+	}
+	return self.sum
+}
+
+func formatCarbonLine(metric string, value float64, ts int64) string {
+	return fmt.Sprintf("%s %s %d", metric, formatValue(value, 64), ts)
+}
+
+// formatStoredLine is formatCarbonLine for values which come from the
+// storage: they are float32, and digits beyond its precision are noise.
+func formatStoredLine(metric string, value float64, ts int64) string {
+	return fmt.Sprintf("%s %s %d", metric, formatValue(value, 32), ts)
+}
+
+func formatValue(value float64, bit_size int) string {
+	if value == math.Trunc(value) && math.Abs(value) < 1e15 {
+		return strconv.FormatInt(int64(value), 10)
+	}
+	return strconv.FormatFloat(value, 'g', -1, bit_size)
+}
+
+// RollupLines returns Carbon protocol lines for the bucket starting at bucket_ts:
+// one line per metric with a non-zero value, and one per matched rollup rule.
+func (self *Storage) RollupLines(bucket_ts int64, rules []*RollupRule) []string {
+	lines := make([]string, 0)
+	accumulators := make([]rollupAccumulator, len(rules))
+	self.RLock()
+	defer self.RUnlock()
+	for name, m := range self.metrics {
+		value := m.GetValueAt(bucket_ts)
+		if value == 0 {
+			continue
+		}
+		lines = append(lines, formatStoredLine(name, value, bucket_ts))
+		for i, rule := range rules {
+			if matchesPattern(m.splitName, rule.split) {
+				accumulators[i].add(value)
+			}
+		}
+	}
+	for i, rule := range rules {
+		if accumulators[i].count > 0 {
+			lines = append(lines, formatStoredLine(rule.Target, accumulators[i].result(rule.Method), bucket_ts))
+		}
+	}
+	return lines
+}
+
+// RollupLoop forwards every bucket once it is closed, waiting
+// --fwd-rollup-delay for late arrivals. Buckets missed while the loop was
+// busy are caught up, as long as they are still stored.
+func (self *AlmazServer) RollupLoop() {
+	var last_sent int64
+	for {
+		p := self.pipeline()
+		dt := int64(p.config.PrecisionInSeconds)
+		delay := int64(p.config.FwdRollupDelay)
+		if dt <= 0 {
+			time.Sleep(time.Second)
+			continue
+		}
+		now := time.Now().Unix() - delay
+		next_boundary := (now/dt + 1) * dt
+		time.Sleep(time.Duration(next_boundary-now) * time.Second)
+
+		closed := (time.Now().Unix()-delay)/dt*dt - dt
+		if last_sent == 0 || !p.rollup || p.relay == nil {
+			last_sent = closed - dt
+		}
+		if oldest := closed - int64(p.config.DurationInHours)*60*60; last_sent < oldest {
+			last_sent = oldest
+		}
+		if !p.rollup || p.relay == nil {
+			continue
+		}
+		for ts := last_sent/dt*dt + dt; ts <= closed; ts += dt {
+			self.forwardRollup(p, ts)
+		}
+		last_sent = closed
+	}
+}
+
+func (self *AlmazServer) forwardRollup(p *Pipeline, bucket_ts int64) {
+	self.RLock()
+	lines := self.storage.RollupLines(bucket_ts, p.rollup_rules)
+	self.RUnlock()
+	for _, line := range lines {
+		p.relay.Route(line)
+	}
+	if p.config.Debug {
+		log.Printf("Forwarded %d rolled up metrics for %d", len(lines), bucket_ts)
+	}
+}
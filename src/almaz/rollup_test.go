@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func Test_ParseRollupRule(t *testing.T) {
+	rule, err := ParseRollupRule("stats.shows.all = sum(stats.shows.*)")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, rule.Target, "stats.shows.all")
+	AssertEqual(t, rule.Method, "sum")
+	AssertEqual(t, rule.split, []string{"stats", "shows", "*"})
+
+	rule, err = ParseRollupRule("  a.max=max( a.*.b )")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, rule.Method, "max")
+	AssertEqual(t, rule.Pattern, "a.*.b")
+
+	_, err = ParseRollupRule("a.b = median(a.*)")
+	AssertEqual(t, err != nil, true)
+	_, err = ParseRollupRule("a.b sum(a.*)")
+	AssertEqual(t, err != nil, true)
+}
+
+func Test_RollupLines(t *testing.T) {
+	s := NewStorage()
+	s.SetStorageParams(1, 10)
+	s.StoreMetric("stats.shows.a", 1, 100)
+	s.StoreMetric("stats.shows.a", 2, 105)
+	s.StoreMetric("stats.shows.b", 4, 101)
+	s.StoreMetric("stats.shows.c", 0.5, 110) // next bucket
+	s.StoreMetric("stats.clicks", 7, 109)
+
+	rules := make([]*RollupRule, 0)
+	for _, r := range []string{
+		"stats.shows.all = sum(stats.shows.*)",
+		"stats.shows.avg = avg(stats.shows.*)",
+		"stats.shows.min = min(stats.shows.*)",
+		"stats.shows.count = count(stats.shows.*)",
+		"stats.views.all = sum(stats.views.*)",
+	} {
+		rule, err := ParseRollupRule(r)
+		AssertEqual(t, err, nil)
+		rules = append(rules, rule)
+	}
+
+	lines := s.RollupLines(100, rules)
+	sort.Strings(lines[:3])
+	AssertEqual(t, lines, []string{
+		"stats.clicks 7 100",
+		"stats.shows.a 3 100",
+		"stats.shows.b 4 100",
+		"stats.shows.all 7 100",
+		"stats.shows.avg 3.5 100",
+		"stats.shows.min 3 100",
+		"stats.shows.count 2 100",
+	})
+
+	lines = s.RollupLines(110, rules)
+	AssertEqual(t, len(lines), 5)
+	AssertEqual(t, lines[0], "stats.shows.c 0.5 110")
+
+	// small values keep their digits
+	s.StoreMetric("stats.rate", 0.1, 120)
+	s.StoreMetric("stats.tiny", 2e-7, 130)
+	AssertEqual(t, s.RollupLines(120, nil), []string{"stats.rate 0.1 120"})
+	AssertEqual(t, s.RollupLines(130, nil), []string{"stats.tiny 2e-07 130"})
+	AssertEqual(t, formatValue(1234567, 64), "1234567")
+	AssertEqual(t, formatValue(1.5e20, 64), "1.5e+20")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// selfCounters are almaz's own counters; see SelfStats.
+type selfCounters struct {
+	lines_received int64
+	parse_errors   int64
+	rejected       int64
+	pruned         int64
+	queries        int64
+	query_nanos    int64
+	save_nanos     int64 // duration of the last save
+}
+
+// SelfStat is one of almaz's own metrics: a counter, which only grows,
+// or a gauge.
+type SelfStat struct {
+	Name    string
+	Value   float64
+	Counter bool
+}
+
+// SelfStats returns the current values of almaz's own metrics.
+func (self *AlmazServer) SelfStats() []*SelfStat {
+	c := &self.counters
+	var queue_length int
+	if relay := self.pipeline().relay; relay != nil {
+		for _, stats := range relay.Stats() {
+			queue_length += stats.QueueLength
+		}
+	}
+	return []*SelfStat{
+		{"lines_received", float64(atomic.LoadInt64(&c.lines_received)), true},
+		{"parse_errors", float64(atomic.LoadInt64(&c.parse_errors)), true},
+		{"samples_rejected", float64(atomic.LoadInt64(&c.rejected)), true},
+		{"metrics_created", float64(self.storage.Created()), true},
+		{"metrics_pruned", float64(atomic.LoadInt64(&c.pruned)), true},
+		{"metrics_evicted", float64(atomic.LoadInt64(&self.evicted)), true},
+		{"queries", float64(atomic.LoadInt64(&c.queries)), true},
+		{"query_seconds", float64(atomic.LoadInt64(&c.query_nanos)) / 1e9, true},
+		{"metrics", float64(self.storage.MetricCount()), false},
+		{"forwarder_queue", float64(queue_length), false},
+		{"save_seconds", float64(atomic.LoadInt64(&c.save_nanos)) / 1e9, false},
+		{"subscribers", float64(len(self.GetSubscribers())), false},
+	}
+}
+
+// SelfPrefix returns the prefix of almaz's own metrics, with <host>
+// replaced by the host name; empty if they are turned off.
+func SelfPrefix(template string) string {
+	if template == "" {
+		return ""
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return strings.Replace(template, "<host>", strings.Replace(host, ".", "_", -1), -1)
+}
+
+// SelfStatsLoop stores almaz's own metrics every --precision-in-seconds:
+// increments of counters, values of gauges, and the average query latency.
+func (self *AlmazServer) SelfStatsLoop() {
+	previous := make(map[string]float64)
+	for {
+		config := self.config()
+		dt := config.PrecisionInSeconds
+		if dt <= 0 {
+			dt = DEFAULT_DT
+		}
+		time.Sleep(time.Duration(dt) * time.Second)
+		prefix := SelfPrefix(config.SelfPrefix)
+		if prefix == "" {
+			continue
+		}
+		self.storeSelfStats(prefix, previous, time.Now().Unix())
+	}
+}
+
+func (self *AlmazServer) storeSelfStats(prefix string, previous map[string]float64, now int64) {
+	stats := self.SelfStats()
+	deltas := make(map[string]float64)
+	for _, stat := range stats {
+		if !stat.Counter {
+			self.storage.SetMetricValue(prefix+stat.Name, stat.Value, now)
+			continue
+		}
+		last, seen := previous[stat.Name]
+		previous[stat.Name] = stat.Value
+		if !seen {
+			continue
+		}
+		deltas[stat.Name] = stat.Value - last
+		self.storage.StoreAdmitted(prefix+stat.Name, stat.Value-last, now)
+	}
+	if deltas["queries"] > 0 {
+		latency := deltas["query_seconds"] / deltas["queries"]
+		self.storage.SetMetricValue(prefix+"query_latency_ms", latency*1000, now)
+	}
+}
+
+// timedQuery counts queries served by the handler and their latency.
+func (self *AlmazServer) timedQuery(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t1 := time.Now()
+		handler(w, r)
+		atomic.AddInt64(&self.counters.queries, 1)
+		atomic.AddInt64(&self.counters.query_nanos, int64(time.Now().Sub(t1)))
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_SelfStats(t *testing.T) {
+	server := NewAlmazServer()
+	err := server.ApplyConfig(&Config{
+		DurationInHours:    1,
+		PrecisionInSeconds: 10,
+		Filter:             []string{`deny ^junk\.`},
+	})
+	AssertEqual(t, err, nil)
+
+	previous := make(map[string]float64)
+	server.storeSelfStats("almaz.test.", previous, 1000)
+	AssertEqual(t, server.storage.HasMetric("almaz.test.lines_received"), false) // counters start with the next bucket
+	AssertEqual(t, server.storage.metrics["almaz.test.metrics"].GetValueAt(1000), 0)
+
+	server.processLine("a 1 1000", nil)
+	server.processLine("b 1 1000", nil)
+	server.processLine("junk.a 1 1000", nil)
+	server.processLine("a x 1000", nil)
+	server.storeSelfStats("almaz.test.", previous, 1010)
+
+	metrics := server.storage.metrics
+	AssertEqual(t, metrics["almaz.test.lines_received"].GetValueAt(1010), 4)
+	AssertEqual(t, metrics["almaz.test.parse_errors"].GetValueAt(1010), 1)
+	AssertEqual(t, metrics["almaz.test.samples_rejected"].GetValueAt(1010), 1)
+	AssertEqual(t, metrics["almaz.test.metrics_created"].GetValueAt(1010), 2+4) // a, b and 4 gauges
+	AssertEqual(t, metrics["almaz.test.metrics"].GetValueAt(1010), 2+4)
+
+	server.storeSelfStats("almaz.test.", previous, 1020)
+	AssertEqual(t, metrics["almaz.test.lines_received"].GetValueAt(1020), 0)
+}
+
+func Test_SelfPrefix(t *testing.T) {
+	AssertEqual(t, SelfPrefix(""), "")
+	AssertEqual(t, SelfPrefix("almaz.self."), "almaz.self.")
+}
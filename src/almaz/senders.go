@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Senders keeps ingestion statistics per sending host, to find hosts
+// which misbehave.
+type Senders struct {
+	sync.Mutex
+	senders   map[string]*SenderStats
+	max_hosts int
+}
+
+type SenderStats struct {
+	Lines          int64  `json:"lines"` // lines or samples, depending on the protocol
+	Bytes          int64  `json:"bytes"`
+	Errors         int64  `json:"errors"`
+	LastError      string `json:"last_error,omitempty"`
+	LastErrorLine  string `json:"last_error_line,omitempty"`
+	LastSeen       int64  `json:"last_seen"`       // unix time
+	FutureRejected int64  `json:"future_rejected"` // samples too far ahead of the clock, see Storage.CheckTimestamp
+	FutureClamped  int64  `json:"future_clamped"`
+	Denied         int64  `json:"denied"` // samples outside prefixes allowed by the client certificate
+}
+
+const (
+	// SenderMaxErrorLine limits the length of the last error line kept.
+	SenderMaxErrorLine = 512
+	// Stats of long connections are updated every SenderFlushLines lines,
+	// and with the first line after SenderFlushInterval.
+	SenderFlushLines    = 1000
+	SenderFlushInterval = 10 * time.Second
+	// SenderMaxHosts limits the number of hosts kept; the host seen
+	// least recently is forgotten to make room for a new one.
+	SenderMaxHosts = 10000
+)
+
+func NewSenders() *Senders {
+	return &Senders{senders: make(map[string]*SenderStats), max_hosts: SenderMaxHosts}
+}
+
+// SenderHost strips the port from a remote address.
+func SenderHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// get returns stats of the sender; the lock must be held.
+func (self *Senders) get(sender *Sender) *SenderStats {
+	stats, ok := self.senders[sender.Host]
+	if !ok {
+		if len(self.senders) >= self.max_hosts {
+			self.forgetOldest()
+		}
+		stats = &SenderStats{}
+		self.senders[sender.Host] = stats
+	}
+	return stats
+}
+
+// forgetOldest removes the host seen least recently; the lock must be held.
+func (self *Senders) forgetOldest() {
+	oldest := ""
+	var oldest_seen int64
+	for host, stats := range self.senders {
+		if oldest == "" || stats.LastSeen < oldest_seen {
+			oldest, oldest_seen = host, stats.LastSeen
+		}
+	}
+	delete(self.senders, oldest)
+}
+
+// Seen counts lines (or samples) and bytes received from the sender.
+func (self *Senders) Seen(sender *Sender, lines int, bytes int) {
+	if sender == nil {
+		return
+	}
+	self.Lock()
+	defer self.Unlock()
+	stats := self.get(sender)
+	stats.Lines += int64(lines)
+	stats.Bytes += int64(bytes)
+	stats.LastSeen = time.Now().Unix()
+}
+
+// Failed counts a malformed line from the sender.
+func (self *Senders) Failed(sender *Sender, line string, err error) {
+	if sender == nil {
+		return
+	}
+	if len(line) > SenderMaxErrorLine {
+		line = line[:SenderMaxErrorLine]
+	}
+	self.Lock()
+	defer self.Unlock()
+	stats := self.get(sender)
+	stats.Errors++
+	stats.LastError = err.Error()
+	stats.LastErrorLine = line
+}
+
+// CountFuture counts a sample from the future, clamped or rejected.
+func (self *Senders) CountFuture(sender *Sender, clamped bool) {
+	if sender == nil {
+		return
+	}
+	self.Lock()
+	defer self.Unlock()
+	if clamped {
+		self.get(sender).FutureClamped++
+	} else {
+		self.get(sender).FutureRejected++
+	}
+}
+
+// CountDenied counts a sample of a metric the sender may not write.
+func (self *Senders) CountDenied(sender *Sender) {
+	if sender == nil {
+		return
+	}
+	self.Lock()
+	defer self.Unlock()
+	self.get(sender).Denied++
+}
+
+// Stats returns a copy of stats of all senders.
+func (self *Senders) Stats() map[string]SenderStats {
+	self.Lock()
+	defer self.Unlock()
+	stats := make(map[string]SenderStats, len(self.senders))
+	for sender, s := range self.senders {
+		stats[sender] = *s
+	}
+	return stats
+}
+
+func (self *AlmazServer) http_sender_stats(w http.ResponseWriter, r *http.Request) {
+	stats := self.senders.Stats()
+
+	json_bytes, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error while formatting json response: %s", err), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json_bytes)
+}
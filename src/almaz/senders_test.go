@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_SenderHost(t *testing.T) {
+	AssertEqual(t, SenderHost("10.0.0.1:34567"), "10.0.0.1")
+	AssertEqual(t, SenderHost("[::1]:34567"), "::1")
+	AssertEqual(t, SenderHost("10.0.0.1"), "10.0.0.1")
+}
+
+func Test_FutureSamplesPerSender(t *testing.T) {
+	server := NewAlmazServer()
+	err := server.ApplyConfig(&Config{DurationInHours: 1, PrecisionInSeconds: 10, FutureTolerance: 600})
+	AssertEqual(t, err, nil)
+	now := time.Now().Unix()
+	future := fmt.Sprintf("a.b 1 %d", now+3600)
+
+	_, outcome := server.ingestLine(&Sender{Host: "10.0.0.1"}, future, nil)
+	AssertEqual(t, outcome.rejected, 1)
+	server.ingestLine(&Sender{Host: "10.0.0.1"}, future, nil)
+	server.ingestLine(&Sender{Host: "10.0.0.2"}, fmt.Sprintf("a.b 1 %d", now), nil)
+	server.processLine(future, nil) // unknown sender
+	AssertEqual(t, server.storage.MetricCount(), 1)
+	AssertEqual(t, server.senders.Stats(), map[string]SenderStats{"10.0.0.1": {FutureRejected: 2}})
+	AssertEqual(t, server.counters.rejected, int64(3))
+
+	err = server.ApplyConfig(&Config{DurationInHours: 1, PrecisionInSeconds: 10, FutureTolerance: 600, FuturePolicy: "clamp"})
+	AssertEqual(t, err, nil)
+	_, outcome = server.ingestLine(&Sender{Host: "10.0.0.1"}, future, nil)
+	AssertEqual(t, outcome.accepted, 1)
+	AssertEqual(t, server.storage.metrics["a.b"].GetSumBetween(now-10, now+10), 2)
+	AssertEqual(t, server.senders.Stats()["10.0.0.1"], SenderStats{FutureRejected: 2, FutureClamped: 1})
+
+	err = server.ApplyConfig(&Config{DurationInHours: 1, PrecisionInSeconds: 10, FuturePolicy: "drop"})
+	AssertEqual(t, err != nil, true)
+}
+
+func Test_SenderDiagnostics(t *testing.T) {
+	server := NewAlmazServer()
+	err := server.ApplyConfig(&Config{DurationInHours: 1, PrecisionInSeconds: 10})
+	AssertEqual(t, err, nil)
+
+	body := "a.b 1 100\na.b x 100\nput a.c 100 1 host\nnot a carbon line\n"
+	r := httptest.NewRequest("POST", "/almaz/ingest", strings.NewReader(body))
+	r.RemoteAddr = "10.0.0.1:34567"
+	server.http_ingest(httptest.NewRecorder(), r)
+	stats := server.senders.Stats()["10.0.0.1"]
+	AssertEqual(t, stats.Lines, 4)
+	AssertEqual(t, stats.Bytes, len(body)-1)
+	AssertEqual(t, stats.Errors, 3)
+	AssertEqual(t, stats.LastError, ErrNotCarbonLine)
+	AssertEqual(t, stats.LastErrorLine, "not a carbon line")
+	AssertEqual(t, stats.LastSeen >= time.Now().Unix()-1, true)
+
+	r = httptest.NewRequest("POST", "/write", strings.NewReader("cpu usage=1 100\ncpu usage=\n"))
+	r.RemoteAddr = "10.0.0.2:34567"
+	server.http_influx_write(httptest.NewRecorder(), r)
+	stats = server.senders.Stats()["10.0.0.2"]
+	AssertEqual(t, stats.Lines, 2)
+	AssertEqual(t, stats.Errors, 1)
+	AssertEqual(t, stats.LastErrorLine, "cpu usage=")
+
+	server.senders.Failed(&Sender{Host: "10.0.0.2"}, strings.Repeat("x", 1000), ErrNotCarbonLine)
+	AssertEqual(t, len(server.senders.Stats()["10.0.0.2"].LastErrorLine), SenderMaxErrorLine)
+
+	w := httptest.NewRecorder()
+	server.http_sender_stats(w, httptest.NewRequest("GET", "/almaz/admin/senders/", nil))
+	AssertEqual(t, strings.HasPrefix(w.Body.String(), `{"10.0.0.1":{"lines":4,`), true)
+	AssertEqual(t, w.Header().Get("Content-Type"), "application/json")
+}
+
+func Test_SendersCap(t *testing.T) {
+	senders := NewSenders()
+	senders.max_hosts = 2
+	senders.Seen(&Sender{Host: "10.0.0.1"}, 1, 10)
+	senders.Seen(&Sender{Host: "10.0.0.2"}, 1, 10)
+	senders.senders["10.0.0.2"].LastSeen -= 60
+	senders.Seen(&Sender{Host: "10.0.0.1"}, 1, 10)
+	senders.Seen(&Sender{Host: "10.0.0.3"}, 1, 10)
+	stats := senders.Stats()
+	AssertEqual(t, len(stats), 2)
+	AssertEqual(t, stats["10.0.0.1"].Lines, 2)
+	AssertEqual(t, stats["10.0.0.3"].Lines, 1)
+}
+
+func Test_SenderSeenWhileConnected(t *testing.T) {
+	server := NewAlmazServer()
+	err := server.ApplyConfig(&Config{DurationInHours: 1, PrecisionInSeconds: 10})
+	AssertEqual(t, err, nil)
+	client, conn := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		server.handleGraphiteConnection(conn)
+		done <- true
+	}()
+	// the first line is counted before the connection is closed
+	client.Write([]byte("a.b 1 100\n"))
+	waitFor(t, func() bool { return server.senders.Stats()["pipe"].Lines == 1 })
+	client.Close()
+	<-done
+}
@@ -2,16 +2,17 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/json"
 	"github.com/gorilla/websocket"
 	"log"
 	"net"
 	"os"
 	"os/signal"
-	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"utils"
@@ -19,25 +20,30 @@ import (
 
 type AlmazServer struct {
 	sync.RWMutex
-	acceptance_regexen []*regexp.Regexp
 	storage            *Storage
-	persist_path       string
 	subscribers        []*StreamSubscriber
-	last_pushed_update []byte
+	last_pushed_update atomic.Value // []byte
 	event_logger       *EventDurationLogger
+	limiter            *Limiter
+	senders            *Senders
+	evicted            int64
+	counters           selfCounters
+	current_pipeline   atomic.Value
+	config_path        string
 }
 
 type StreamSubscriber struct {
 	conn *websocket.Conn
 }
 
-func NewAlmazServer(persist_path string) *AlmazServer {
+func NewAlmazServer() *AlmazServer {
 	s := new(AlmazServer)
-	s.acceptance_regexen = make([]*regexp.Regexp, 0)
 	s.storage = NewStorage()
-	s.persist_path = persist_path
+	s.limiter = NewLimiter()
+	s.storage.SetLimiter(s.limiter)
+	s.senders = NewSenders()
 	s.subscribers = make([]*StreamSubscriber, 0)
-	s.last_pushed_update = make([]byte, 0)
+	s.last_pushed_update.Store(make([]byte, 0))
 	s.event_logger = NewEventDurationLogger()
 	return s
 }
@@ -76,18 +82,23 @@ func (self *AlmazServer) GetSubscribers() []*StreamSubscriber {
 	return subs
 }
 
-func (self *AlmazServer) AddAcceptanceRegex(re string) {
-	rx := regexp.MustCompile(re)
-	log.Printf("storing only metrics that match %s", re)
-	self.acceptance_regexen = append(self.acceptance_regexen, rx)
+// SetConfigPath sets the config file which is read again on SIGHUP.
+func (self *AlmazServer) SetConfigPath(path string) {
+	self.config_path = path
 }
 
-func (self *AlmazServer) StartGraphite(bindAddress string) {
+// StartGraphite listens for Carbon lines, over TLS if tls_config is set.
+func (self *AlmazServer) StartGraphite(bindAddress string, tls_config *tls.Config) {
 	listener, err := net.Listen("tcp", bindAddress)
 	if err != nil {
 		log.Fatalf("failed to listen: %s", err)
 	}
-	log.Printf("listening on %s", bindAddress)
+	if tls_config != nil {
+		listener = tls.NewListener(listener, tls_config)
+		log.Printf("listening on %s (TLS)", bindAddress)
+	} else {
+		log.Printf("listening on %s", bindAddress)
+	}
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -118,63 +129,173 @@ func (self *AlmazServer) handleGraphiteConnection(conn net.Conn) {
 	defer self.RUnlock()
 	t1 := time.Now()
 
-	var fwd_conn net.Conn = nil
-	var err error
-
 	metric_updates := make([]*MetricUpdate, 0)
-
-	if *fwdAddress != "" {
-		fwd_conn, err = net.Dial("tcp", *fwdAddress)
-		if err != nil {
-			//log.Printf("forward conn error: %s", err)
-		} else {
-			defer fwd_conn.Close()
-		}
+	sender := self.ConnectionSender(conn)
+	if sender == nil {
+		return
 	}
 
+	lines, bytes := 0, 0
+	var flushed time.Time // the first line is counted at once
 	scanner := bufio.NewScanner(conn)
 	for scanner.Scan() {
-		trimmedString := scanner.Text()
-		parts := strings.Split(trimmedString, " ")
-		if len(parts) == 3 {
-			metric := parts[0]
-			value, err1 := strconv.ParseFloat(parts[1], 32)
-			ts, err2 := strconv.ParseInt(parts[2], 10, 64)
-			if err1 != nil || err2 != nil {
-				log.Printf("parse error: %s %s", err1, err2)
-				continue
-			}
-
-			accepted := false
-			if len(self.acceptance_regexen) == 0 {
-				accepted = true
-			} else {
-				for _, rx := range self.acceptance_regexen {
-					if rx.MatchString(metric) {
-						accepted = true
-						break
-					}
-				}
-			}
-			if accepted && value > 0 {
-				total := self.storage.StoreMetric(metric, value, ts)
-				upd := NewMetricUpdate(metric, value, int(total))
-				metric_updates = append(metric_updates, upd)
-			}
+		line := scanner.Text()
+		var outcome lineOutcome
+		metric_updates, outcome = self.ingestLine(sender, line, metric_updates)
+		if outcome.err != nil {
+			log.Printf("parse error from %s: %s in %q", sender.Host, outcome.err, line)
 		}
-		if fwd_conn != nil {
-			fwd_conn.Write([]byte(trimmedString + "\n"))
+		lines, bytes = lines+1, bytes+len(line)+1
+		if lines == SenderFlushLines || time.Since(flushed) >= SenderFlushInterval {
+			self.senders.Seen(sender, lines, bytes)
+			lines, bytes = 0, 0
+			flushed = time.Now()
 		}
 	}
+	self.senders.Seen(sender, lines, bytes)
 	t2 := time.Now()
 	dt := t2.Sub(t1)
 	go self.PushUpstream(metric_updates)
-	if *debug {
+	if self.config().Debug {
 		log.Printf("Processed metrics batch in %s; storing %d metrics now",
 			dt.String(), self.storage.MetricCount())
 	}
 }
 
+// processLine stores and forwards a single line of Carbon protocol
+// (or an OpenTSDB put).
+func (self *AlmazServer) processLine(line string, metric_updates []*MetricUpdate) []*MetricUpdate {
+	metric_updates, outcome := self.ingestLine(nil, line, metric_updates)
+	if outcome.err != nil {
+		log.Printf("parse error: %s in %q", outcome.err, line)
+	}
+	return metric_updates
+}
+
+// lineOutcome tells what happened to the samples of a line: accepted
+// samples are stored or forwarded, rejected ones are refused by filters
+// or limits; err is set for malformed lines. Lines which aren't
+// <metric> <value> <timestamp> are forwarded as they are (raw).
+type lineOutcome struct {
+	accepted int
+	rejected int
+	raw      bool
+	err      error
+}
+
+// ingestLine is processLine for lines of a known sender.
+func (self *AlmazServer) ingestLine(sender *Sender, line string, metric_updates []*MetricUpdate) ([]*MetricUpdate, lineOutcome) {
+	if strings.HasPrefix(line, "put ") {
+		return self.ingestOpenTSDBPut(sender, line, metric_updates)
+	}
+	var outcome lineOutcome
+	p := self.pipeline()
+	atomic.AddInt64(&self.counters.lines_received, 1)
+	parts := strings.Split(line, " ")
+	if len(parts) == 2 {
+		parts = append(parts, "N") // no timestamp
+	}
+	if len(parts) != 3 {
+		outcome.raw = true
+		if sender.Restricted() {
+			// can't tell which metric it is, so it can't be allowed
+			atomic.AddInt64(&self.counters.rejected, 1)
+			self.senders.CountDenied(sender)
+			outcome.rejected++
+			return metric_updates, outcome
+		}
+		p.forwardLine(line)
+		return metric_updates, outcome
+	}
+	now := time.Now().Unix()
+	if parts[2] == "N" || parts[2] == "-1" {
+		parts[2] = strconv.FormatInt(now, 10) // stamped on receipt
+	}
+	value, err1 := strconv.ParseFloat(parts[1], 32)
+	ts, err2 := strconv.ParseInt(parts[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		outcome.err = err1
+		if outcome.err == nil {
+			outcome.err = err2
+		}
+		atomic.AddInt64(&self.counters.parse_errors, 1)
+		self.senders.Failed(sender, line, outcome.err)
+		return metric_updates, outcome
+	}
+	return self.ingestSample(sender, p, parts[0], value, parts[1], ts, now, metric_updates)
+}
+
+// ingestValue is ingestLine for samples of other protocols, which are
+// already parsed.
+func (self *AlmazServer) ingestValue(sender *Sender, name string, value float64, ts int64, metric_updates []*MetricUpdate) ([]*MetricUpdate, lineOutcome) {
+	p := self.pipeline()
+	atomic.AddInt64(&self.counters.lines_received, 1)
+	value_text := strconv.FormatFloat(value, 'g', -1, 64)
+	return self.ingestSample(sender, p, name, value, value_text, ts, time.Now().Unix(), metric_updates)
+}
+
+// ingestSample stores and forwards a parsed sample; value_text is
+// the value as it is forwarded.
+func (self *AlmazServer) ingestSample(sender *Sender, p *Pipeline, name string, value float64, value_text string, ts int64, now int64, metric_updates []*MetricUpdate) ([]*MetricUpdate, lineOutcome) {
+	var outcome lineOutcome
+	ts_text := strconv.FormatInt(ts, 10)
+	checked_ts, ok := self.storage.CheckTimestamp(ts, now)
+	if !ok {
+		atomic.AddInt64(&self.counters.rejected, 1)
+		self.senders.CountFuture(sender, false)
+		outcome.rejected++
+		return metric_updates, outcome
+	}
+	if checked_ts != ts {
+		self.senders.CountFuture(sender, true)
+		ts = checked_ts
+		ts_text = strconv.FormatInt(ts, 10)
+	}
+	normalized, err := NormalizeTaggedName(name)
+	if err != nil {
+		outcome.err = err
+		atomic.AddInt64(&self.counters.parse_errors, 1)
+		self.senders.Failed(sender, name+" "+value_text+" "+ts_text, outcome.err)
+		return metric_updates, outcome
+	}
+	if !sender.Allows(normalized) {
+		atomic.AddInt64(&self.counters.rejected, 1)
+		self.senders.CountDenied(sender)
+		outcome.rejected++
+		return metric_updates, outcome
+	}
+
+	for _, metric := range p.rewrite_rules.Rewrite(normalized) {
+		accepted := p.filter.Accept(metric)
+		if accepted && value > 0 {
+			total, admitted := self.storage.StoreAdmitted(metric, value, ts)
+			if admitted {
+				upd := NewMetricUpdate(metric, value, int(total))
+				metric_updates = append(metric_updates, upd)
+				if p.aggregator != nil {
+					p.aggregator.Process(metric, value, ts)
+				}
+			} else {
+				accepted = false
+			}
+		}
+		if accepted {
+			outcome.accepted++
+		} else {
+			atomic.AddInt64(&self.counters.rejected, 1)
+			outcome.rejected++
+		}
+		p.forwardLine(metric + " " + value_text + " " + ts_text)
+	}
+	return metric_updates, outcome
+}
+
+func (self *Pipeline) forwardLine(line string) {
+	if self.relay != nil && !self.rollup {
+		self.relay.Route(line)
+	}
+}
+
 func (self *AlmazServer) PushUpstream(metric_updates []*MetricUpdate) {
 	subscribers := self.GetSubscribers()
 	json_bytes, err := json.Marshal(metric_updates)
@@ -182,7 +303,7 @@ func (self *AlmazServer) PushUpstream(metric_updates []*MetricUpdate) {
 		log.Printf("json encode error: %s", err)
 		return
 	}
-	self.last_pushed_update = json_bytes
+	self.last_pushed_update.Store(json_bytes)
 	for _, sub := range subscribers {
 		if sub.conn == nil {
 			continue
@@ -196,41 +317,13 @@ func (self *AlmazServer) PushUpstream(metric_updates []*MetricUpdate) {
 	}
 }
 
-func (self *AlmazServer) AuditLoop() {
-	for {
-		time.Sleep(33 * time.Second)
-		self.PruneOld()
-		log.Printf("Audit: metric number = %d", self.storage.MetricCount())
-	}
-}
-
-func (self *AlmazServer) PruneOld() {
-	self.Lock()
-	defer self.Unlock()
-	ts := time.Now().Unix()
-
-	to_remove := make([]string, 0)
-
-	for name, metric := range self.storage.metrics {
-		if metric.Age() < ts {
-			to_remove = append(to_remove, name)
-		}
-	}
-
-	for _, name := range to_remove {
-		self.storage.RemoveMetric(name)
-	}
-	if len(to_remove) > 0 {
-		log.Printf("%d old metrics pruned", len(to_remove))
-	}
-}
-
 func (self *AlmazServer) LoadFromDisk() {
 	self.Lock()
 	defer self.Unlock()
 	log.Printf("Restoring from disk...")
 	t1 := time.Now()
-	err := self.storage.LoadFromFile(self.persist_path)
+	err := self.storage.LoadFromFile(self.config().PersistPath)
+	self.limiter.Recount(self.storage.Metrics())
 	if err != nil {
 		log.Printf("Error while loading from disk: %s", err)
 	} else {
@@ -245,16 +338,77 @@ func (self *AlmazServer) SaveToDisk() {
 	defer self.Unlock()
 	log.Printf("Saving to disk...")
 	t1 := time.Now()
-	err := self.storage.SaveToFile(self.persist_path)
+	config := self.config()
+	var err error
+	if config.PersistKeep > 0 {
+		err = self.saveSnapshot(config.PersistPath, config.PersistKeep, t1)
+	} else {
+		err = self.storage.SaveToFile(config.PersistPath)
+	}
 	if err != nil {
 		log.Printf("Error while saving to disk: %s", err)
 	} else {
 		t2 := time.Now()
 		dt := t2.Sub(t1)
+		atomic.StoreInt64(&self.counters.save_nanos, int64(dt))
 		log.Printf("Done saving (%s)", dt)
 	}
 }
 
+// saveSnapshot saves a snapshot with the timestamp in its name, points
+// persist_path to it and keeps only the last `keep` snapshots.
+func (self *AlmazServer) saveSnapshot(persist_path string, keep int, now time.Time) error {
+	path := SnapshotPath(persist_path, now)
+	err := self.storage.SaveToFile(path)
+	if err != nil {
+		return err
+	}
+	err = linkLatestSnapshot(path, persist_path)
+	if err != nil {
+		return err
+	}
+	return RotateSnapshots(persist_path, keep)
+}
+
+func (self *AlmazServer) RestoreSnapshot(snapshot *SnapshotInfo, replace bool) error {
+	metrics, err := ReadMetricsFromFile(snapshot.path)
+	if err != nil {
+		return err
+	}
+	// the storage takes its own lock; the server lock is held by Carbon
+	// connections for as long as they last
+	self.storage.Restore(metrics, replace)
+	self.limiter.Recount(self.storage.Metrics())
+	log.Printf("Restored %d metrics from %s (replace: %v)", len(metrics), snapshot.Name, replace)
+	return nil
+}
+
+func (self *AlmazServer) ImportWhisper(dir string) {
+	self.Lock()
+	defer self.Unlock()
+	log.Printf("Importing whisper files from %s...", dir)
+	t1 := time.Now()
+	n, err := self.storage.ImportWhisper(dir, t1.Unix())
+	self.limiter.Recount(self.storage.Metrics())
+	if err != nil {
+		log.Printf("Error while importing whisper files: %s", err)
+	}
+	log.Printf("Imported %d whisper files (%s)", n, time.Now().Sub(t1))
+}
+
+func (self *AlmazServer) ExportWhisper(dir string) {
+	self.RLock()
+	defer self.RUnlock()
+	log.Printf("Exporting whisper files to %s...", dir)
+	t1 := time.Now()
+	err := self.storage.ExportWhisper(dir)
+	if err != nil {
+		log.Printf("Error while exporting whisper files: %s", err)
+	} else {
+		log.Printf("Done exporting (%s)", time.Now().Sub(t1))
+	}
+}
+
 func (self *AlmazServer) ForkAndSaveToDisk() {
 	if utils.DoubleFork() > 0 {
 		return
@@ -270,26 +424,43 @@ func (self *AlmazServer) BgsaveLoop(interval_seconds int) {
 	}
 }
 
-func (self *AlmazServer) WaitForTermination(persist_on_exit bool, bgsave_interval int) {
-	var bgsave_int_duration = time.Duration(bgsave_interval) * time.Second
-	if !persist_on_exit || bgsave_int_duration <= 0 {
-		bgsave_int_duration = time.Duration(60) * time.Second
+func (self *AlmazServer) bgsaveInterval() time.Duration {
+	config := self.config()
+	interval := time.Duration(config.PersistInterval) * time.Second
+	if !config.Persist || interval <= 0 {
+		interval = time.Duration(60) * time.Second
 	}
+	return interval
+}
 
+// WaitForTermination runs background saves, reloads the config on SIGHUP
+// and saves to disk on exit if persistence is on.
+func (self *AlmazServer) WaitForTermination() {
 	impeding_death := make(chan os.Signal, 1)
 	signal.Notify(impeding_death, syscall.SIGINT, syscall.SIGTERM)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 
+	bgsave_int_duration := self.bgsaveInterval()
 	bgsave_ticker := time.NewTicker(bgsave_int_duration)
 
 	for {
 		select {
 		case <-bgsave_ticker.C:
-			if persist_on_exit && bgsave_interval > 0 {
+			config := self.config()
+			if config.Persist && config.PersistInterval > 0 {
 				self.ForkAndSaveToDisk()
 			}
+		case <-reload:
+			self.ReloadConfig()
+			if interval := self.bgsaveInterval(); interval != bgsave_int_duration {
+				bgsave_int_duration = interval
+				bgsave_ticker.Stop()
+				bgsave_ticker = time.NewTicker(bgsave_int_duration)
+			}
 		case s := <-impeding_death:
-			log.Printf("Got signal:", s)
-			if persist_on_exit {
+			log.Printf("Got signal: %s", s)
+			if self.config().Persist {
 				self.SaveToDisk()
 			}
 			return
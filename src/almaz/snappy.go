@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// SnappyMaxDecodedLength limits memory taken by a single decoded block.
+const SnappyMaxDecodedLength = 64 << 20
+
+var ErrCorruptSnappy = errors.New("snappy: corrupt input")
+
+// SnappyDecode decodes a block in the snappy format (not the framed stream
+// format), as used by Prometheus remote_write. See
+// https://github.com/google/snappy/blob/master/format_description.txt
+func SnappyDecode(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 || length > SnappyMaxDecodedLength {
+		return nil, ErrCorruptSnappy
+	}
+	src = src[n:]
+	dst := make([]byte, 0, length)
+	for len(src) > 0 {
+		tag := src[0]
+		var offset, count int
+		switch tag & 3 {
+		case 0: // literal
+			count = int(tag >> 2)
+			src = src[1:]
+			if count >= 60 {
+				size := count - 59
+				if len(src) < size {
+					return nil, ErrCorruptSnappy
+				}
+				count = 0
+				for i := size - 1; i >= 0; i-- {
+					count = count<<8 | int(src[i])
+				}
+				src = src[size:]
+			}
+			count++
+			if count <= 0 || len(src) < count || uint64(len(dst)+count) > length {
+				return nil, ErrCorruptSnappy
+			}
+			dst = append(dst, src[:count]...)
+			src = src[count:]
+			continue
+		case 1:
+			if len(src) < 2 {
+				return nil, ErrCorruptSnappy
+			}
+			count = 4 + int(tag>>2)&7
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case 2:
+			if len(src) < 3 {
+				return nil, ErrCorruptSnappy
+			}
+			count = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:3]))
+			src = src[3:]
+		case 3:
+			if len(src) < 5 {
+				return nil, ErrCorruptSnappy
+			}
+			count = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:5]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+count) > length {
+			return nil, ErrCorruptSnappy
+		}
+		// copies may overlap their own output
+		start := len(dst) - offset
+		for i := 0; i < count; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+	if uint64(len(dst)) != length {
+		return nil, ErrCorruptSnappy
+	}
+	return dst, nil
+}
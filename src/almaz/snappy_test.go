@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// snappyLiteral encodes data as a single literal, which is valid snappy.
+func snappyLiteral(data []byte) []byte {
+	var buf bytes.Buffer
+	n := len(data)
+	buf.Write(appendUvarint(nil, uint64(n)))
+	if n == 0 {
+		return buf.Bytes()
+	}
+	if n <= 60 {
+		buf.WriteByte(byte(n-1) << 2)
+	} else {
+		buf.WriteByte(62 << 2) // 3-byte length follows
+		buf.Write([]byte{byte(n - 1), byte((n - 1) >> 8), byte((n - 1) >> 16)})
+	}
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func Test_SnappyDecode(t *testing.T) {
+	// "abc" literal followed by a 1-byte offset copy overlapping itself
+	out, err := SnappyDecode([]byte{12, 2 << 2, 'a', 'b', 'c', 1 | 5<<2, 3})
+	AssertEqual(t, err, nil)
+	AssertEqual(t, string(out), "abcabcabcabc")
+
+	// 2-byte offset copy
+	out, err = SnappyDecode([]byte{8, 3 << 2, 'a', 'b', 'c', 'd', 2 | 3<<2, 4, 0})
+	AssertEqual(t, err, nil)
+	AssertEqual(t, string(out), "abcdabcd")
+
+	long := bytes.Repeat([]byte("0123456789"), 1000)
+	out, err = SnappyDecode(snappyLiteral(long))
+	AssertEqual(t, err, nil)
+	AssertEqual(t, out, long)
+
+	for _, corrupt := range [][]byte{
+		{},
+		{5, 2 << 2, 'a', 'b', 'c'},      // shorter than declared
+		{3, 1 | 0<<2, 1},                // copy before any output
+		{2, 3 << 2, 'a', 'b', 'c', 'd'}, // longer than declared
+		{4, 60 << 2},                    // truncated literal length
+	} {
+		_, err = SnappyDecode(corrupt)
+		AssertEqual(t, err, ErrCorruptSnappy)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SnapshotTimeFormat = "20060102-150405"
+)
+
+type SnapshotInfo struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+	path string
+}
+
+// snapshotPattern splits persist path "dir/almaz.dat" into "dir/almaz." and ".dat";
+// snapshots are named "dir/almaz.<time>.dat".
+func snapshotPattern(persist_path string) (string, string) {
+	ext := filepath.Ext(persist_path)
+	return strings.TrimSuffix(persist_path, ext) + ".", ext
+}
+
+// sameSnapshotPattern tells whether timestamped files of both paths are
+// listed as snapshots of each other.
+func sameSnapshotPattern(a, b string) bool {
+	a_prefix, a_suffix := snapshotPattern(filepath.Clean(a))
+	b_prefix, b_suffix := snapshotPattern(filepath.Clean(b))
+	return a_prefix == b_prefix && a_suffix == b_suffix
+}
+
+func SnapshotPath(persist_path string, t time.Time) string {
+	prefix, suffix := snapshotPattern(persist_path)
+	return prefix + t.UTC().Format(SnapshotTimeFormat) + suffix
+}
+
+// NewSnapshotPath is SnapshotPath which doesn't overwrite existing files:
+// snapshots made within the same second are named "dir/almaz.<time>-2.dat"
+// and so on.
+func NewSnapshotPath(persist_path string, t time.Time) string {
+	path := SnapshotPath(persist_path, t)
+	prefix, suffix := snapshotPattern(path)
+	for n := 2; ; n++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path
+		}
+		path = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(prefix, "."), n, suffix)
+	}
+}
+
+// ListSnapshots returns timestamped snapshots of persist_path, newest first.
+func ListSnapshots(persist_path string) ([]*SnapshotInfo, error) {
+	prefix, suffix := snapshotPattern(persist_path)
+	paths, err := filepath.Glob(prefix + "*" + suffix)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]*SnapshotInfo, 0, len(paths))
+	for _, path := range paths {
+		ts := strings.TrimSuffix(strings.TrimPrefix(path, prefix), suffix)
+		if i := strings.LastIndexByte(ts, '-'); len(ts) > len(SnapshotTimeFormat) && i == len(SnapshotTimeFormat) {
+			if _, err := strconv.Atoi(ts[i+1:]); err != nil {
+				continue
+			}
+			ts = ts[:i] // numbered by NewSnapshotPath
+		}
+		t, err := time.Parse(SnapshotTimeFormat, ts)
+		if err != nil {
+			continue
+		}
+		stat, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, &SnapshotInfo{
+			Name: filepath.Base(path),
+			Time: t,
+			Size: stat.Size(),
+			path: path,
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		a, b := snapshots[i], snapshots[j]
+		if !a.Time.Equal(b.Time) {
+			return a.Time.After(b.Time)
+		}
+		// within the same second "-10" is newer than "-9", which is newer than none
+		if len(a.Name) != len(b.Name) {
+			return len(a.Name) > len(b.Name)
+		}
+		return a.Name > b.Name
+	})
+	return snapshots, nil
+}
+
+func FindSnapshot(persist_path string, name string) *SnapshotInfo {
+	snapshots, err := ListSnapshots(persist_path)
+	if err != nil {
+		return nil
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Name == name {
+			return snapshot
+		}
+	}
+	return nil
+}
+
+// RotateSnapshots removes all but the newest `keep` snapshots.
+func RotateSnapshots(persist_path string, keep int) error {
+	snapshots, err := ListSnapshots(persist_path)
+	if err != nil {
+		return err
+	}
+	for i := keep; i < len(snapshots); i++ {
+		err = os.Remove(snapshots[i].path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkLatestSnapshot atomically points persist_path to the given snapshot,
+// so that loading at startup always picks up the newest one.
+func linkLatestSnapshot(snapshot_path string, persist_path string) error {
+	temppath := persist_path + ".tmp"
+	os.Remove(temppath)
+	err := os.Link(snapshot_path, temppath)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(temppath, persist_path)
+	if err != nil {
+		os.Remove(temppath)
+		return err
+	}
+	return nil
+}
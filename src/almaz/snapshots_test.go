@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_SnapshotRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almaz-test")
+	AssertEqual(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	persist_path := filepath.Join(dir, "almaz.dat")
+	server := NewAlmazServer()
+	server.storage.SetStorageParams(1, 10)
+
+	t0 := time.Date(2013, 8, 25, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		server.storage.StoreMetric("a.b", 1, int64(i*10))
+		AssertEqual(t, server.saveSnapshot(persist_path, 2, t0.Add(time.Duration(i)*time.Minute)), nil)
+	}
+
+	snapshots, err := ListSnapshots(persist_path)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(snapshots), 2)
+	AssertEqual(t, snapshots[0].Name, "almaz.20130825-120300.dat")
+	AssertEqual(t, snapshots[1].Name, "almaz.20130825-120200.dat")
+
+	latest := NewStorage()
+	AssertEqual(t, latest.LoadFromFile(persist_path), nil)
+	AssertEqual(t, latest.metrics["a.b"].GetSumBetween(0, 100), 4)
+
+	AssertEqual(t, FindSnapshot(persist_path, "../almaz.dat") == nil, true)
+}
+
+func Test_RestoreSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almaz-test")
+	AssertEqual(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	persist_path := filepath.Join(dir, "almaz.dat")
+	server := NewAlmazServer()
+	server.storage.SetStorageParams(1, 10)
+	server.storage.StoreMetric("good", 1, 10)
+	AssertEqual(t, server.saveSnapshot(persist_path, 1, time.Unix(100, 0)), nil)
+
+	server.storage.RemoveMetric("good")
+	server.storage.StoreMetric("good", 2, 20)
+	server.storage.StoreMetric("garbage", 1, 20)
+
+	// values of the snapshot fill the gaps, live values are kept
+	snapshot := FindSnapshot(persist_path, "almaz.19700101-000140.dat")
+	AssertEqual(t, server.RestoreSnapshot(snapshot, false), nil)
+	AssertEqual(t, server.storage.MetricCount(), 2)
+	AssertEqual(t, server.storage.metrics["good"].GetValueAt(10), 1)
+	AssertEqual(t, server.storage.metrics["good"].GetValueAt(20), 2)
+	AssertEqual(t, server.RestoreSnapshot(snapshot, false), nil)
+	AssertEqual(t, server.storage.metrics["good"].GetSumBetween(0, 100), 3)
+
+	// restoring doesn't wait for Carbon connections, which hold the server lock
+	server.RLock()
+	AssertEqual(t, server.RestoreSnapshot(snapshot, true), nil)
+	server.RUnlock()
+	AssertEqual(t, server.storage.MetricCount(), 1)
+	AssertEqual(t, server.storage.metrics["good"].LastAccess() >= time.Now().Unix()-1, true)
+	AssertEqual(t, server.storage.metrics["good"].splitName, []string{"good"})
+}
+
+func Test_NewSnapshotPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almaz-test")
+	AssertEqual(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	persist_path := filepath.Join(dir, "almaz.dat")
+	now := time.Unix(100, 0)
+	for i := 0; i < 3; i++ {
+		path := NewSnapshotPath(persist_path, now)
+		AssertEqual(t, ioutil.WriteFile(path, []byte{}, 0644), nil)
+	}
+	snapshots, err := ListSnapshots(persist_path)
+	AssertEqual(t, err, nil)
+	names := make([]string, 0)
+	for _, snapshot := range snapshots {
+		names = append(names, snapshot.Name)
+	}
+	AssertEqual(t, names, []string{"almaz.19700101-000140-3.dat", "almaz.19700101-000140-2.dat", "almaz.19700101-000140.dat"})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	SpoolSegmentExtension = ".seg"
+	SpoolSegmentBytes     = 4 * 1024 * 1024
+)
+
+// Spool is a size-bounded queue of lines on disk, split into segment files
+// which are appended to and consumed in order. It is used by Forwarder
+// when its in-memory queue overflows, and survives restarts.
+type Spool struct {
+	sync.Mutex
+	dir           string
+	max_bytes     int64
+	segment_bytes int64
+	segments      []int64 // ids of segment files, oldest first
+	size          int64
+	writer        *os.File
+	writer_id     int64
+	writer_size   int64
+}
+
+func OpenSpool(dir string, max_bytes int64, segment_bytes int64) (*Spool, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	s := &Spool{}
+	s.dir = dir
+	s.max_bytes = max_bytes
+	s.segment_bytes = segment_bytes
+	s.segments = make([]int64, 0)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), SpoolSegmentExtension) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(file.Name(), SpoolSegmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, id)
+		s.size += file.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+	return s, nil
+}
+
+func (self *Spool) segmentPath(id int64) string {
+	return filepath.Join(self.dir, fmt.Sprintf("%016d%s", id, SpoolSegmentExtension))
+}
+
+// Append adds a line to the end of the spool; it returns false if the line
+// doesn't fit into the size limit or cannot be written.
+func (self *Spool) Append(line string) bool {
+	self.Lock()
+	defer self.Unlock()
+	n := int64(len(line) + 1)
+	if self.size+n > self.max_bytes {
+		return false
+	}
+	if self.writer != nil && self.writer_size >= self.segment_bytes {
+		self.closeWriter()
+	}
+	if self.writer == nil {
+		id := int64(1)
+		if len(self.segments) > 0 {
+			id = self.segments[len(self.segments)-1] + 1
+		}
+		f, err := os.OpenFile(self.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return false
+		}
+		self.writer = f
+		self.writer_id = id
+		self.writer_size = 0
+		self.segments = append(self.segments, id)
+	}
+	_, err := self.writer.WriteString(line + "\n")
+	if err != nil {
+		return false
+	}
+	self.writer_size += n
+	self.size += n
+	return true
+}
+
+func (self *Spool) closeWriter() {
+	self.writer.Close()
+	self.writer = nil
+}
+
+// Empty is true when every spooled line has been consumed with RemoveSegment.
+func (self *Spool) Empty() bool {
+	self.Lock()
+	defer self.Unlock()
+	return len(self.segments) == 0
+}
+
+func (self *Spool) Size() int64 {
+	self.Lock()
+	defer self.Unlock()
+	return self.size
+}
+
+// ReadSegment returns lines of the oldest segment. The segment stays in the
+// spool until it is removed with RemoveSegment.
+func (self *Spool) ReadSegment() (int64, []string, error) {
+	self.Lock()
+	defer self.Unlock()
+	if len(self.segments) == 0 {
+		return 0, nil, nil
+	}
+	id := self.segments[0]
+	if self.writer != nil && self.writer_id == id {
+		self.closeWriter()
+	}
+	data, err := ioutil.ReadFile(self.segmentPath(id))
+	if err != nil {
+		return id, nil, err
+	}
+	content := strings.TrimSuffix(string(data), "\n")
+	if content == "" {
+		return id, []string{}, nil
+	}
+	return id, strings.Split(content, "\n"), nil
+}
+
+func (self *Spool) RemoveSegment(id int64) error {
+	self.Lock()
+	defer self.Unlock()
+	if len(self.segments) == 0 || self.segments[0] != id {
+		return fmt.Errorf("segment %d is not the oldest one", id)
+	}
+	path := self.segmentPath(id)
+	stat, err := os.Stat(path)
+	if err == nil {
+		self.size -= stat.Size()
+	}
+	self.segments = self.segments[1:]
+	return os.Remove(path)
+}
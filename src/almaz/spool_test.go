@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func Test_SpoolSurvivesReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almaz-test")
+	AssertEqual(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenSpool(dir, 1000, 20)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, spool.Empty(), true)
+	for i := 0; i < 5; i++ {
+		AssertEqual(t, spool.Append(fmt.Sprintf("a.b %d 100", i)), true)
+	}
+	AssertEqual(t, spool.Size(), 5*10)
+
+	spool, err = OpenSpool(dir, 1000, 20)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, spool.Size(), 5*10)
+	lines := make([]string, 0)
+	for !spool.Empty() {
+		id, segment, err := spool.ReadSegment()
+		AssertEqual(t, err, nil)
+		lines = append(lines, segment...)
+		AssertEqual(t, spool.RemoveSegment(id), nil)
+	}
+	AssertEqual(t, lines, []string{"a.b 0 100", "a.b 1 100", "a.b 2 100", "a.b 3 100", "a.b 4 100"})
+	AssertEqual(t, spool.Size(), 0)
+}
+
+func Test_SpoolSizeLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almaz-test")
+	AssertEqual(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenSpool(dir, 25, 1000)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, spool.Append("a.b 0 100"), true)
+	AssertEqual(t, spool.Append("a.b 1 100"), true)
+	AssertEqual(t, spool.Append("a.b 2 100"), false)
+
+	// appending after the writer's segment has been read starts a new one
+	id, lines, err := spool.ReadSegment()
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(lines), 2)
+	AssertEqual(t, spool.RemoveSegment(id), nil)
+	AssertEqual(t, spool.Append("a.b 3 100"), true)
+	_, lines, err = spool.ReadSegment()
+	AssertEqual(t, lines, []string{"a.b 3 100"})
+}
+
+func Test_ForwarderDrainsSpoolInOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almaz-test")
+	AssertEqual(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	AssertEqual(t, err, nil)
+	address := listener.Addr().String()
+	listener.Close()
+
+	spool, err := OpenSpool(dir, 1000, 30)
+	AssertEqual(t, err, nil)
+	f := NewForwarder(address, 1, 10)
+	f.SetSpool(spool)
+	f.Start()
+	expected := make([]string, 0)
+	for i := 0; i < 6; i++ {
+		line := fmt.Sprintf("a.b %d 100", i)
+		expected = append(expected, line)
+		f.Enqueue(line)
+	}
+
+	listener, err = net.Listen("tcp", address)
+	AssertEqual(t, err, nil)
+	defer listener.Close()
+	lines := make(chan string, 10)
+	go receiveLines(listener, lines)
+
+	expectLines(t, lines, expected...)
+	waitFor(t, func() bool { return f.Stats().Forwarded == 6 })
+	stats := f.Stats()
+	AssertEqual(t, stats.Dropped, 0)
+	AssertEqual(t, stats.Queued+stats.Spilled, 6)
+	AssertEqual(t, stats.SpoolBytes, 0)
+	AssertEqual(t, spool.Empty(), true)
+}
+
+func Test_ForwarderSpoolsQueueOnStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almaz-test")
+	AssertEqual(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenSpool(dir, 1000, 1000)
+	AssertEqual(t, err, nil)
+	f := NewForwarder("127.0.0.1:1", 10, 10) // nothing listens there
+	f.SetSpool(spool)
+	f.Enqueue("a.b 1 100")
+	f.Enqueue("a.b 2 100")
+	f.Start()
+	f.Stop()
+	waitFor(t, func() bool { return f.Stats().Spilled == 2 })
+	_, lines, err := spool.ReadSegment()
+	AssertEqual(t, err, nil)
+	AssertEqual(t, lines, []string{"a.b 1 100", "a.b 2 100"})
+}
@@ -8,6 +8,8 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -15,10 +17,19 @@ const (
 	DEFAULT_DT       = 60
 )
 
+// Storage guards its metrics map with its own lock; values of a metric
+// are guarded by the metric's lock.
 type Storage struct {
-	metrics  map[string]*Metric
-	duration int
-	dt       int
+	sync.RWMutex
+	metrics            map[string]*Metric
+	duration           int
+	dt                 int
+	compress_snapshots bool
+	created            int64                                 // metrics created so far
+	tag_index          map[string]map[string]map[string]bool // tag -> value -> series
+	max_lead           int64                                 // seconds a sample may be ahead of the clock, 0 --- no limit; atomic
+	clamp_future       int32                                 // 1 --- store samples beyond max_lead at now instead of rejecting them; atomic
+	limiter            *Limiter                              // admits metrics created by StoreAdmitted and SetMetricValue, if set
 }
 
 type Metric struct {
@@ -30,6 +41,7 @@ type Metric struct {
 	latest_ts_k int64 // == timestamp / dt
 	splitName   []string
 	total       float32
+	last_access int64 // unix time of the last write or query, for eviction
 }
 
 type StoredMetric struct {
@@ -39,6 +51,15 @@ type StoredMetric struct {
 	Latest_i    int
 	Latest_ts_k int64
 	Total       float32
+	Packed      []byte // Array compressed with PackFloat32Array, if set
+	Length      int    // len(Array) before compression
+}
+
+// packedMetric is a Metric which is gob-encoded with its array compressed.
+// It is wire-compatible with Metric, so snapshots made of packedMetrics
+// are loaded by the usual Storage.LoadFromFile.
+type packedMetric struct {
+	metric *Metric
 }
 
 func NewStorage() *Storage {
@@ -51,7 +72,7 @@ func NewStorage() *Storage {
 
 func NewMetric(duration, dt int, starting_ts int64, name string) *Metric {
 	m := new(Metric)
-	m.splitName = strings.Split(name, ".")
+	m.splitName = strings.Split(BaseName(name), ".")
 	m.latest_i = 0
 	m.duration = duration
 	m.dt = dt
@@ -61,19 +82,90 @@ func NewMetric(duration, dt int, starting_ts int64, name string) *Metric {
 	return m
 }
 
+// StoreMetric adds value to the metric, creating it if needed.
+// The storage lock is held while the value is stored, so that
+// the metric can't be pruned in between.
 func (self *Storage) StoreMetric(metric_name string, value float64, ts int64) float64 {
+	total, _ := self.store(metric_name, value, ts, false)
+	return total
+}
+
+// StoreAdmitted is StoreMetric which creates the metric only if the
+// limiter admits it; it returns false if the sample is rejected.
+func (self *Storage) StoreAdmitted(metric_name string, value float64, ts int64) (float64, bool) {
+	return self.store(metric_name, value, ts, true)
+}
+
+func (self *Storage) store(metric_name string, value float64, ts int64, limited bool) (float64, bool) {
+	self.RLock()
+	metric, ok := self.metrics[metric_name]
+	if ok {
+		metric.touch()
+		r := metric.Store(float32(value), ts)
+		self.RUnlock()
+		return float64(r), true
+	}
+	self.RUnlock()
+
+	self.Lock()
+	defer self.Unlock()
+	metric, ok = self.metrics[metric_name]
+	if ok {
+		metric.touch()
+		return float64(metric.Store(float32(value), ts)), true
+	}
+	metric = self.create(metric_name, ts, limited)
+	if metric == nil {
+		return 0, false
+	}
+	metric.array[0] += float32(value)
+	return value, true
+}
+
+// create adds a new metric; the write lock must be held. With limited,
+// it returns nil if the limiter doesn't admit the metric, so that
+// concurrent samples of the same new metric are admitted (and counted)
+// only once.
+func (self *Storage) create(metric_name string, ts int64, limited bool) *Metric {
+	if limited && self.limiter != nil && self.limiter.AdmitNew(metric_name, time.Now().Unix()) != "" {
+		return nil
+	}
+	metric := NewMetric(self.duration, self.dt, ts, metric_name)
+	self.created++
+	metric.touch()
+	self.metrics[metric_name] = metric
+	self.indexTags(metric_name)
+	return metric
+}
+
+// SetMetricValue replaces the value of the metric's bucket ts falls into,
+// creating the metric if the limiter admits it; it returns false otherwise.
+func (self *Storage) SetMetricValue(metric_name string, value float64, ts int64) bool {
+	self.Lock()
+	defer self.Unlock()
 	metric, ok := self.metrics[metric_name]
 	if !ok {
-		metric = NewMetric(self.duration, self.dt, ts, metric_name)
-		metric.array[0] += float32(value)
-		self.metrics[metric_name] = metric
-		return value
+		metric = self.create(metric_name, ts, true)
+		if metric == nil {
+			return false
+		}
 	}
-	r := metric.Store(float32(value), ts)
-	return float64(r)
+	metric.touch()
+	metric.Set(float32(value), ts)
+	return true
+}
+
+// SetLimiter makes new metrics of StoreAdmitted and SetMetricValue
+// subject to cardinality limits.
+func (self *Storage) SetLimiter(limiter *Limiter) {
+	self.Lock()
+	defer self.Unlock()
+	self.limiter = limiter
 }
 
 func (self *Storage) SetTotal(metric_name string, total float64) {
+	self.RLock()
+	defer self.RUnlock()
 	metric, ok := self.metrics[metric_name]
 	if !ok {
 		return
@@ -83,13 +175,45 @@ func (self *Storage) SetTotal(metric_name string, total float64) {
 }
 
 func (self *Storage) RemoveMetric(metric_name string) {
-	delete(self.metrics, metric_name)
+	self.Lock()
+	defer self.Unlock()
+	if _, ok := self.metrics[metric_name]; ok {
+		delete(self.metrics, metric_name)
+		self.unindexTags(metric_name)
+	}
+}
+
+func (self *Storage) HasMetric(metric_name string) bool {
+	self.RLock()
+	defer self.RUnlock()
+	_, ok := self.metrics[metric_name]
+	return ok
 }
 
 func (self *Storage) MetricCount() int {
+	self.RLock()
+	defer self.RUnlock()
 	return len(self.metrics)
 }
 
+// Created returns the number of metrics created since start.
+func (self *Storage) Created() int64 {
+	self.RLock()
+	defer self.RUnlock()
+	return self.created
+}
+
+// Metrics returns a copy of the metrics map.
+func (self *Storage) Metrics() map[string]*Metric {
+	self.RLock()
+	defer self.RUnlock()
+	metrics := make(map[string]*Metric, len(self.metrics))
+	for name, metric := range self.metrics {
+		metrics[name] = metric
+	}
+	return metrics
+}
+
 func (self *Storage) SetStorageParams(duration_hours int, precision_seconds int) {
 	if duration_hours <= 0 {
 		log.Fatal("duration must be greater than zero")
@@ -97,10 +221,40 @@ func (self *Storage) SetStorageParams(duration_hours int, precision_seconds int)
 	if precision_seconds <= 0 {
 		log.Fatal("precision must be greater than zero")
 	}
+	self.Lock()
+	defer self.Unlock()
 	self.duration = duration_hours * 60 * 60
 	self.dt = precision_seconds
 }
 
+// SetClockSkewGuard limits how far ahead of the clock samples may be,
+// see CheckTimestamp.
+func (self *Storage) SetClockSkewGuard(max_lead int, clamp bool) {
+	var clamp_future int32
+	if clamp {
+		clamp_future = 1
+	}
+	atomic.StoreInt64(&self.max_lead, int64(max_lead))
+	atomic.StoreInt32(&self.clamp_future, clamp_future)
+}
+
+// CheckTimestamp guards metrics against senders with clocks running ahead:
+// a single sample far in the future makes Store wipe the history of its
+// metric and drop correct samples afterwards. It returns the timestamp
+// to store the sample at, clamped to now if so configured, and false
+// if the sample must be rejected. It is called for every sample, so it
+// doesn't take the storage lock.
+func (self *Storage) CheckTimestamp(ts int64, now int64) (int64, bool) {
+	max_lead := atomic.LoadInt64(&self.max_lead)
+	if max_lead <= 0 || ts <= now+max_lead {
+		return ts, true
+	}
+	if atomic.LoadInt32(&self.clamp_future) == 1 {
+		return now, true
+	}
+	return ts, false
+}
+
 func matchesPattern(s []string, pattern []string) bool {
 	if len(s) != len(pattern) {
 		return false
@@ -113,17 +267,33 @@ func matchesPattern(s []string, pattern []string) bool {
 	return true
 }
 
+// SumByPeriodGroupingQuery sums metrics matching each pattern over periods;
+// a pattern is either a dotted name with * wildcards, matched against
+// names without tags, or seriesByTag(...). Malformed seriesByTag
+// patterns match nothing; http_list_group rejects them beforehand.
 func (self *Storage) SumByPeriodGroupingQuery(metric_group_patterns []string, periods []int64, now int64, interpolate bool) [][]float64 {
+	self.RLock()
+	defer self.RUnlock()
 	sums := make([][]float64, len(metric_group_patterns))
 	split_patterns := make([][]string, len(metric_group_patterns))
+	tagged := make([]map[string]bool, len(metric_group_patterns))
 	for i := range metric_group_patterns {
 		sums[i] = make([]float64, len(periods))
+		if IsSeriesByTag(metric_group_patterns[i]) {
+			exprs, err := ParseSeriesByTag(metric_group_patterns[i])
+			if err != nil {
+				exprs = nil
+			}
+			tagged[i] = self.seriesByTag(exprs)
+			continue
+		}
 		split_patterns[i] = strings.Split(metric_group_patterns[i], ".")
 	}
 
-	for _, m := range self.metrics {
+	for name, m := range self.metrics {
 		for i := range split_patterns {
-			if matchesPattern(m.splitName, split_patterns[i]) {
+			if tagged[i] != nil && tagged[i][name] || tagged[i] == nil && matchesPattern(m.splitName, split_patterns[i]) {
+				m.touch()
 				this_metric_sum := m.GetSumsPerPeriodUntilNowWithInterpolation(periods, now, interpolate)
 				for j := range periods {
 					sums[i][j] += this_metric_sum[j]
@@ -135,6 +305,18 @@ func (self *Storage) SumByPeriodGroupingQuery(metric_group_patterns []string, pe
 	return sums
 }
 
+func (self *Storage) SetSnapshotCompression(compress bool) {
+	self.Lock()
+	defer self.Unlock()
+	self.compress_snapshots = compress
+}
+
+func (self *Storage) SnapshotCompression() bool {
+	self.RLock()
+	defer self.RUnlock()
+	return self.compress_snapshots
+}
+
 func (self *Storage) SaveToFile(filename string) error {
 	temppath := filename + ".tmp"
 	tempfile, err := os.Create(temppath)
@@ -142,8 +324,18 @@ func (self *Storage) SaveToFile(filename string) error {
 		return err
 	}
 
+	self.RLock()
 	enc := gob.NewEncoder(tempfile)
-	err = enc.Encode(self.metrics)
+	if self.compress_snapshots {
+		packed := make(map[string]*packedMetric, len(self.metrics))
+		for name, metric := range self.metrics {
+			packed[name] = &packedMetric{metric}
+		}
+		err = enc.Encode(packed)
+	} else {
+		err = enc.Encode(self.metrics)
+	}
+	self.RUnlock()
 	if err != nil {
 		tempfile.Close()
 		os.Remove(temppath)
@@ -158,38 +350,131 @@ func (self *Storage) SaveToFile(filename string) error {
 	return nil
 }
 
-func (self *Storage) LoadFromFile(filename string) error {
+func ReadMetricsFromFile(filename string) (map[string]*Metric, error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer file.Close()
+	metrics := make(map[string]*Metric)
 	dec := gob.NewDecoder(file)
-	err = dec.Decode(&self.metrics)
+	err = dec.Decode(&metrics)
+	if err != nil {
+		return nil, err
+	}
+	for name, metric := range metrics {
+		metric.splitName = strings.Split(BaseName(name), ".")
+	}
+	return metrics, nil
+}
+
+func (self *Storage) LoadFromFile(filename string) error {
+	metrics, err := ReadMetricsFromFile(filename)
 	if err != nil {
 		return err
 	}
+	self.Lock()
+	self.metrics = metrics
+	self.reindexTags()
+	self.Unlock()
 	return nil
 }
 
+// Restore puts metrics read from a snapshot into the storage.
+// With replace, the storage ends up containing exactly the snapshot;
+// otherwise snapshot values fill buckets of live metrics which have
+// no value (see Metric.Merge), metrics only in the snapshot are added
+// and metrics missing from the snapshot are kept.
+func (self *Storage) Restore(metrics map[string]*Metric, replace bool) {
+	self.Lock()
+	defer self.Unlock()
+	for _, metric := range metrics {
+		metric.touch() // restored metrics are not the first to be evicted
+	}
+	if replace {
+		self.metrics = metrics
+		self.reindexTags()
+		return
+	}
+	for name, metric := range metrics {
+		if live, ok := self.metrics[name]; ok {
+			live.Merge(metric)
+			continue
+		}
+		self.metrics[name] = metric
+		self.indexTags(name)
+	}
+}
+
+// Merge fills buckets which have no value with values of the other
+// metric, e.g. one read from a snapshot. Buckets with live values are
+// kept as they are, so merging the same snapshot twice changes nothing.
+func (self *Metric) Merge(other *Metric) {
+	other.RLock()
+	defer other.RUnlock()
+	self.Lock()
+	defer self.Unlock()
+	filled := make(map[int]bool) // several buckets of other may fall into one with a larger dt
+	n := len(other.array)
+	for d := n - 1; d >= 0; d-- { // oldest first, so that the ring moves forward only once
+		i := other.latest_i - d
+		if i < 0 {
+			i += n
+		}
+		value := other.array[i]
+		if value == 0 {
+			continue
+		}
+		j := self.bucketIndex((other.latest_ts_k - int64(d)) * int64(other.dt))
+		if j < 0 || (self.array[j] != 0 && !filled[j]) {
+			continue
+		}
+		self.array[j] += value
+		self.total += value
+		filled[j] = true
+	}
+}
+
 func (self *Metric) Store(value float32, ts int64) float32 {
 	self.Lock()
 	defer self.Unlock()
-	dt_64 := int64(self.dt)
-	ts_k := ts / dt_64
 	self.total += value
-	/*log.Printf("(%f, %d) ts_k %d, latest_ts_k %d", value, ts, ts_k, self.latest_ts_k)*/
+	/*log.Printf("(%f, %d) ts_k %d, latest_ts_k %d", value, ts, ts/int64(self.dt), self.latest_ts_k)*/
+	i := self.bucketIndex(ts)
+	if i >= 0 {
+		self.array[i] += value
+	}
+	return self.total
+}
+
+// Set replaces the value of the bucket ts falls into.
+func (self *Metric) Set(value float32, ts int64) {
+	self.Lock()
+	defer self.Unlock()
+	i := self.bucketIndex(ts)
+	if i >= 0 {
+		self.total += value - self.array[i]
+		self.array[i] = value
+	}
+}
+
+// bucketIndex returns the position of the bucket for ts in the array,
+// moving the ring forward if ts is newer than the latest bucket,
+// or -1 if ts falls outside the storage period.
+func (self *Metric) bucketIndex(ts int64) int {
+	ts_k := ts / int64(self.dt)
 	if self.latest_ts_k > ts_k {
 		// amend value in the past
-		i := int64(self.latest_i) - (self.latest_ts_k - ts_k)
-		if i < 0 {
-			i += int64(len(self.array))
+		d_ts_k := self.latest_ts_k - ts_k
+		if d_ts_k >= int64(len(self.array)) {
+			// falls outside the storage period
+			return -1
 		}
+		i := self.latest_i - int(d_ts_k)
 		if i < 0 {
-			// falls outside the storage period
-			return self.total
+			i += len(self.array)
 		}
-		return self.total
+		return i
 	}
 	if ts_k > self.latest_ts_k+int64(len(self.array)) {
 		// jump into the future, might as well erase the entire array and start over
@@ -198,16 +483,14 @@ func (self *Metric) Store(value float32, ts int64) float32 {
 		for i := range self.array {
 			self.array[i] = 0.0
 		}
-		self.array[0] = value
-		return self.total
+		return 0
 	}
 	for self.latest_ts_k < ts_k {
 		self.latest_i = (self.latest_i + 1) % len(self.array)
 		self.array[self.latest_i] = 0.0
 		self.latest_ts_k += 1
 	}
-	self.array[self.latest_i] += value
-	return self.total
+	return self.latest_i
 }
 
 func (self *Metric) SetTotal(value float32) {
@@ -332,9 +615,24 @@ func (self *Metric) GetSumsPerPeriodUntilNowWithInterpolation(periods []int64, n
 }
 
 func (self *Metric) GobEncode() ([]byte, error) {
+	return self.encodeStored(false)
+}
+
+func (self *packedMetric) GobEncode() ([]byte, error) {
+	return self.metric.encodeStored(true)
+}
+
+func (self *Metric) encodeStored(compress bool) ([]byte, error) {
+	self.RLock()
+	defer self.RUnlock()
 	var sm StoredMetric
 	var buf bytes.Buffer
-	sm.Array = self.array
+	if compress {
+		sm.Packed = PackFloat32Array(self.array)
+		sm.Length = len(self.array)
+	} else {
+		sm.Array = self.array
+	}
 	sm.Dt = self.dt
 	sm.Duration = self.duration
 	sm.Latest_i = self.latest_i
@@ -356,7 +654,14 @@ func (self *Metric) GobDecode(_bytes []byte) error {
 	if err != nil {
 		return err
 	}
-	self.array = sm.Array
+	if sm.Packed != nil {
+		self.array, err = UnpackFloat32Array(sm.Packed, sm.Length)
+		if err != nil {
+			return err
+		}
+	} else {
+		self.array = sm.Array
+	}
 	self.dt = sm.Dt
 	self.duration = sm.Duration
 	self.latest_i = sm.Latest_i
@@ -366,5 +671,7 @@ func (self *Metric) GobDecode(_bytes []byte) error {
 }
 
 func (self *Metric) Age() int64 {
+	self.RLock()
+	defer self.RUnlock()
 	return self.latest_ts_k * int64(self.dt)
 }
@@ -29,6 +29,22 @@ func Test_Addition(t *testing.T) {
 	AssertEqual(t, m.array[2], 88+11)
 }
 
+// Samples which arrive late, but still within the storage period, are
+// added to their bucket; older ones are dropped.
+func Test_LateSamples(t *testing.T) {
+	m := NewMetric(60, 10, 1, "carbon.test")
+	m.Store(1, 105) // bucket of ts_k 10 is the latest
+	m.Store(2, 52)  // ts_k 5, the oldest bucket still kept
+	m.Store(4, 87)  // ts_k 8
+	m.Store(8, 49)  // ts_k 4, outside the storage period
+	AssertEqual(t, m.latest_ts_k, 10)
+	AssertEqual(t, m.GetValueAt(105), 1)
+	AssertEqual(t, m.GetValueAt(52), 2)
+	AssertEqual(t, m.GetValueAt(87), 4)
+	AssertEqual(t, m.GetValueAt(49), 0)
+	AssertEqual(t, m.GetSumBetween(0, 110), 7)
+}
+
 func Test_Circularity(t *testing.T) {
 	m := NewMetric(60, 10, 1, "carbon.test")
 	m.Store(1, 1)   // bucket 0
@@ -115,6 +131,61 @@ func Test_FarFuture(t *testing.T) {
 
 }
 
+func Test_ClockSkewGuard(t *testing.T) {
+	s := NewStorage()
+	ts, ok := s.CheckTimestamp(1000000, 100) // no limit by default
+	AssertEqual(t, ts, 1000000)
+	AssertEqual(t, ok, true)
+
+	s.SetClockSkewGuard(60, false)
+	ts, ok = s.CheckTimestamp(160, 100)
+	AssertEqual(t, ts, 160)
+	AssertEqual(t, ok, true)
+	ts, ok = s.CheckTimestamp(161, 100)
+	AssertEqual(t, ok, false)
+	ts, ok = s.CheckTimestamp(1, 100) // the past is up to Store
+	AssertEqual(t, ts, 1)
+	AssertEqual(t, ok, true)
+
+	s.SetClockSkewGuard(60, true)
+	ts, ok = s.CheckTimestamp(161, 100)
+	AssertEqual(t, ts, 100)
+	AssertEqual(t, ok, true)
+	ts, ok = s.CheckTimestamp(150, 100)
+	AssertEqual(t, ts, 150)
+	AssertEqual(t, ok, true)
+
+	s.SetClockSkewGuard(0, true)
+	ts, ok = s.CheckTimestamp(1000000, 100)
+	AssertEqual(t, ts, 1000000)
+	AssertEqual(t, ok, true)
+}
+
+func Test_FarFutureGuarded(t *testing.T) {
+	// the sample of Test_FarFuture at 200 doesn't wipe history when guarded
+	s := NewStorage()
+	s.SetStorageParams(1, 10)
+	s.SetClockSkewGuard(30, false)
+	now := int64(64)
+	for _, ts := range []int64{1, 12, 38, 55, 64, 200, 60} {
+		if checked, ok := s.CheckTimestamp(ts, now); ok {
+			s.StoreMetric("carbon.test", float64(ts), checked)
+		}
+	}
+	m := s.metrics["carbon.test"]
+	AssertEqual(t, m.GetValueAt(64), 124)
+	AssertEqual(t, m.GetValueAt(12), 12)
+	AssertEqual(t, m.latest_ts_k, 6)
+
+	s.SetClockSkewGuard(30, true)
+	if checked, ok := s.CheckTimestamp(200, now); ok {
+		s.StoreMetric("carbon.test", 200, checked)
+	}
+	AssertEqual(t, m.GetValueAt(64), 324)
+	AssertEqual(t, m.GetValueAt(1), 1)
+	AssertEqual(t, m.latest_ts_k, 6)
+}
+
 func Test_PeriodSums(t *testing.T) {
 	m := NewMetric(60, 10, 1, "carbon.test")
 	m.Store(1, 1)   // bucket 0
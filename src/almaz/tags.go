@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Graphite 1.1 tagged series carry tags after the name:
+//
+//   disk.used;datacenter=dc1;server=web01 42 1377447313
+//
+// Names are normalized by sorting tags, so the same series sent with tags
+// in a different order is stored once. The bare name is what patterns
+// match against; tags are kept in an index, see SeriesByTag.
+
+var seriesByTagArgRegex = regexp.MustCompile(`^\s*(?:'([^']*)'|"([^"]*)")\s*(?:,|$)`)
+
+// SplitTaggedName returns the bare name and tags of a series name;
+// tags are nil for untagged names.
+func SplitTaggedName(name string) (string, map[string]string, error) {
+	parts := strings.Split(name, ";")
+	if len(parts) == 1 {
+		return name, nil, nil
+	}
+	if parts[0] == "" {
+		return "", nil, fmt.Errorf("bad tagged series %q: missing name", name)
+	}
+	tags := make(map[string]string, len(parts)-1)
+	for _, tag := range parts[1:] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" || strings.ContainsAny(kv[0], "!^") || strings.HasPrefix(kv[1], "~") {
+			return "", nil, fmt.Errorf("bad tagged series %q: bad tag %s", name, tag)
+		}
+		if kv[0] == "name" {
+			return "", nil, fmt.Errorf("bad tagged series %q: tag name is reserved", name)
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return parts[0], tags, nil
+}
+
+// NormalizeTaggedName sorts tags of a series name; untagged names are
+// returned as they are.
+func NormalizeTaggedName(name string) (string, error) {
+	if strings.IndexByte(name, ';') < 0 {
+		return name, nil
+	}
+	base, tags, err := SplitTaggedName(name)
+	if err != nil {
+		return "", err
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{base}
+	for _, k := range keys {
+		parts = append(parts, k+"="+tags[k])
+	}
+	return strings.Join(parts, ";"), nil
+}
+
+// BaseName strips tags from a series name.
+func BaseName(name string) string {
+	if i := strings.IndexByte(name, ';'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// seriesTags returns tags of a stored series including its name as
+// the "name" tag, or nil for an untagged series.
+func seriesTags(name string) map[string]string {
+	base, tags, err := SplitTaggedName(name)
+	if err != nil || tags == nil {
+		return nil
+	}
+	tags["name"] = base
+	return tags
+}
+
+// TagExpression is an argument of seriesByTag: tag=value, tag!=value,
+// tag=~regex or tag!=~regex. Regular expressions are anchored at the
+// start of the value, and an empty value matches series without the tag.
+type TagExpression struct {
+	Tag   string
+	Op    string
+	Value string
+	regex *regexp.Regexp
+}
+
+func ParseTagExpression(s string) (*TagExpression, error) {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return nil, fmt.Errorf("bad tag expression %q, expected tag=value", s)
+	}
+	expr := &TagExpression{Tag: s[:i], Op: "=", Value: s[i+1:]}
+	if strings.HasSuffix(expr.Tag, "!") {
+		expr.Tag = expr.Tag[:len(expr.Tag)-1]
+		expr.Op = "!="
+	}
+	if strings.HasPrefix(expr.Value, "~") {
+		expr.Value = expr.Value[1:]
+		expr.Op += "~"
+		regex, err := regexp.Compile("^(?:" + expr.Value + ")")
+		if err != nil {
+			return nil, fmt.Errorf("bad tag expression %q: %s", s, err)
+		}
+		expr.regex = regex
+	}
+	if expr.Tag == "" {
+		return nil, fmt.Errorf("bad tag expression %q: missing tag", s)
+	}
+	return expr, nil
+}
+
+// Match checks the expression against a value of the tag, "" if the
+// series doesn't have it.
+func (self *TagExpression) Match(value string) bool {
+	switch self.Op {
+	case "=":
+		return value == self.Value
+	case "!=":
+		return value != self.Value
+	case "=~":
+		return self.regex.MatchString(value)
+	default: // "!=~"
+		return !self.regex.MatchString(value)
+	}
+}
+
+// positive tells whether the expression only matches series with the tag.
+func (self *TagExpression) positive() bool {
+	return (self.Op == "=" || self.Op == "=~") && !self.Match("")
+}
+
+func IsSeriesByTag(query string) bool {
+	return strings.HasPrefix(strings.TrimSpace(query), "seriesByTag(")
+}
+
+// ParseSeriesByTag parses seriesByTag('name=disk.used','datacenter=~dc[12]').
+// At least one expression must match only series having its tag.
+func ParseSeriesByTag(query string) ([]*TagExpression, error) {
+	query = strings.TrimSpace(query)
+	if !strings.HasPrefix(query, "seriesByTag(") || !strings.HasSuffix(query, ")") {
+		return nil, fmt.Errorf("bad query %q, expected seriesByTag('tag=value', ...)", query)
+	}
+	args := query[len("seriesByTag(") : len(query)-1]
+	exprs := make([]*TagExpression, 0)
+	has_positive := false
+	for strings.TrimSpace(args) != "" {
+		m := seriesByTagArgRegex.FindStringSubmatch(args)
+		if m == nil {
+			return nil, fmt.Errorf("bad query %q: expected quoted tag expressions", query)
+		}
+		args = args[len(m[0]):]
+		expr, err := ParseTagExpression(m[1] + m[2])
+		if err != nil {
+			return nil, err
+		}
+		has_positive = has_positive || expr.positive()
+		exprs = append(exprs, expr)
+	}
+	if !has_positive {
+		return nil, fmt.Errorf("bad query %q: at least one expression must require a tag value", query)
+	}
+	return exprs, nil
+}
+
+// indexTags adds a series to the tag index; the storage must be locked.
+func (self *Storage) indexTags(name string) {
+	tags := seriesTags(name)
+	if tags == nil {
+		return
+	}
+	if self.tag_index == nil {
+		self.tag_index = make(map[string]map[string]map[string]bool)
+	}
+	for tag, value := range tags {
+		values, ok := self.tag_index[tag]
+		if !ok {
+			values = make(map[string]map[string]bool)
+			self.tag_index[tag] = values
+		}
+		series, ok := values[value]
+		if !ok {
+			series = make(map[string]bool)
+			values[value] = series
+		}
+		series[name] = true
+	}
+}
+
+// unindexTags removes a series from the tag index; the storage must be locked.
+func (self *Storage) unindexTags(name string) {
+	for tag, value := range seriesTags(name) {
+		series := self.tag_index[tag][value]
+		delete(series, name)
+		if len(series) == 0 {
+			delete(self.tag_index[tag], value)
+		}
+		if len(self.tag_index[tag]) == 0 {
+			delete(self.tag_index, tag)
+		}
+	}
+}
+
+// reindexTags rebuilds the tag index; the storage must be locked.
+func (self *Storage) reindexTags() {
+	self.tag_index = nil
+	for name := range self.metrics {
+		self.indexTags(name)
+	}
+}
+
+// seriesByTag returns names of series matching all expressions;
+// the storage must be read-locked.
+func (self *Storage) seriesByTag(exprs []*TagExpression) map[string]bool {
+	result := make(map[string]bool)
+	var first *TagExpression
+	for _, expr := range exprs {
+		if expr.positive() {
+			first = expr
+			break
+		}
+	}
+	if first == nil {
+		return result
+	}
+	for value, series := range self.tag_index[first.Tag] {
+		if !first.Match(value) {
+			continue
+		}
+		for name := range series {
+			tags := seriesTags(name)
+			matches := true
+			for _, expr := range exprs {
+				if !expr.Match(tags[expr.Tag]) {
+					matches = false
+					break
+				}
+			}
+			if matches {
+				result[name] = true
+			}
+		}
+	}
+	return result
+}
+
+// SeriesByTag returns sorted names of series matching all expressions.
+func (self *Storage) SeriesByTag(exprs []*TagExpression) []string {
+	self.RLock()
+	defer self.RUnlock()
+	names := make([]string, 0)
+	for name := range self.seriesByTag(exprs) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Tags returns sorted names of tags of stored series.
+func (self *Storage) Tags() []string {
+	self.RLock()
+	defer self.RUnlock()
+	tags := make([]string, 0, len(self.tag_index))
+	for tag := range self.tag_index {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// TagValues returns the number of series per value of the tag.
+func (self *Storage) TagValues(tag string) map[string]int {
+	self.RLock()
+	defer self.RUnlock()
+	values := make(map[string]int)
+	for value, series := range self.tag_index[tag] {
+		values[value] = len(series)
+	}
+	return values
+}
+
+type TagInfo struct {
+	Tag string `json:"tag"`
+}
+
+type TagValueInfo struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+type TagValuesInfo struct {
+	Tag    string          `json:"tag"`
+	Values []*TagValueInfo `json:"values"`
+}
+
+// http_tags lists tags at /tags and values of a tag at /tags/<tag>,
+// in the format of the Graphite tags API.
+func (self *AlmazServer) http_tags(w http.ResponseWriter, r *http.Request) {
+	tag := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tags"), "/")
+	var result interface{}
+	if tag == "" {
+		tags := make([]*TagInfo, 0)
+		for _, t := range self.storage.Tags() {
+			tags = append(tags, &TagInfo{t})
+		}
+		result = tags
+	} else {
+		info := &TagValuesInfo{Tag: tag, Values: make([]*TagValueInfo, 0)}
+		values := self.storage.TagValues(tag)
+		for value, count := range values {
+			info.Values = append(info.Values, &TagValueInfo{value, count})
+		}
+		sort.Slice(info.Values, func(i, j int) bool { return info.Values[i].Value < info.Values[j].Value })
+		result = info
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error while encoding tags: %s", err), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_NormalizeTaggedName(t *testing.T) {
+	name, err := NormalizeTaggedName("disk.used;server=web01;datacenter=dc1")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, name, "disk.used;datacenter=dc1;server=web01")
+	name, err = NormalizeTaggedName("disk.used")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, name, "disk.used")
+	AssertEqual(t, BaseName("disk.used;datacenter=dc1"), "disk.used")
+
+	for _, bad := range []string{";dc=1", "disk;dc", "disk;dc=", "disk;=1", "disk;dc!=1", "disk;dc=~1", "disk;name=x"} {
+		_, err := NormalizeTaggedName(bad)
+		AssertEqual(t, err != nil, true)
+	}
+}
+
+func Test_ParseSeriesByTag(t *testing.T) {
+	exprs, err := ParseSeriesByTag(`seriesByTag('name=disk.used', "dc!=~eu.*",'host!=')`)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(exprs), 3)
+	AssertEqual(t, exprs[0].Tag+" "+exprs[0].Op+" "+exprs[0].Value, "name = disk.used")
+	AssertEqual(t, exprs[1].Tag+" "+exprs[1].Op+" "+exprs[1].Value, "dc !=~ eu.*")
+	AssertEqual(t, exprs[2].Tag+" "+exprs[2].Op+" "+exprs[2].Value, "host != ")
+
+	for _, bad := range []string{"seriesByTag()", "seriesByTag('dc!=eu')", "seriesByTag(name=x)", "seriesByTag('=x')", "seriesByTag('dc=~(')"} {
+		_, err := ParseSeriesByTag(bad)
+		AssertEqual(t, err != nil, true)
+	}
+}
+
+func Test_SeriesByTag(t *testing.T) {
+	s := NewStorage()
+	s.StoreMetric("disk.used;dc=eu;host=web1", 1, 100)
+	s.StoreMetric("disk.used;dc=us;host=web2", 2, 100)
+	s.StoreMetric("disk.used;dc=eu", 4, 100)
+	s.StoreMetric("disk.free;dc=eu;host=web1", 8, 100)
+	s.StoreMetric("disk.used", 16, 100)
+
+	query := func(q string) []string {
+		exprs, err := ParseSeriesByTag(q)
+		AssertEqual(t, err, nil)
+		return s.SeriesByTag(exprs)
+	}
+	AssertEqual(t, query("seriesByTag('name=disk.used')"), []string{"disk.used;dc=eu", "disk.used;dc=eu;host=web1", "disk.used;dc=us;host=web2"})
+	AssertEqual(t, query("seriesByTag('name=disk.used','dc=eu')"), []string{"disk.used;dc=eu", "disk.used;dc=eu;host=web1"})
+	AssertEqual(t, query("seriesByTag('dc=eu','host=')"), []string{"disk.used;dc=eu"})
+	AssertEqual(t, query("seriesByTag('name=~disk','host!=~web1')"), []string{"disk.used;dc=eu", "disk.used;dc=us;host=web2"})
+
+	AssertEqual(t, s.Tags(), []string{"dc", "host", "name"})
+	AssertEqual(t, s.TagValues("dc"), map[string]int{"eu": 3, "us": 1})
+
+	s.RemoveMetric("disk.used;dc=us;host=web2")
+	AssertEqual(t, s.TagValues("dc"), map[string]int{"eu": 3})
+	s.RemoveMetric("disk.free;dc=eu;host=web1")
+	s.RemoveMetric("disk.used;dc=eu;host=web1")
+	AssertEqual(t, s.Tags(), []string{"dc", "name"})
+
+	sums := s.SumByPeriodGroupingQuery([]string{"seriesByTag('dc=eu')", "disk.*", "seriesByTag('dc!=eu')"}, []int64{60}, 100, false)
+	AssertEqual(t, sums, [][]float64{{4}, {16}, {0}})
+}
+
+func Test_TaggedIngest(t *testing.T) {
+	server := NewAlmazServer()
+	err := server.ApplyConfig(&Config{DurationInHours: 1, PrecisionInSeconds: 10})
+	AssertEqual(t, err, nil)
+	server.processLine("disk.used;server=web01;datacenter=dc1 2 100", nil)
+	server.processLine("disk.used;datacenter=dc1;server=web01 3 100", nil)
+	server.processLine("disk.used;datacenter 3 100", nil)
+	AssertEqual(t, server.storage.MetricCount(), 1)
+	AssertEqual(t, server.storage.metrics["disk.used;datacenter=dc1;server=web01"].GetValueAt(100), 5)
+	AssertEqual(t, server.counters.parse_errors, int64(1))
+
+	w := httptest.NewRecorder()
+	server.http_tags(w, httptest.NewRequest("GET", "/tags", nil))
+	AssertEqual(t, w.Body.String(), `[{"tag":"datacenter"},{"tag":"name"},{"tag":"server"}]`)
+	w = httptest.NewRecorder()
+	server.http_tags(w, httptest.NewRequest("GET", "/tags/datacenter", nil))
+	AssertEqual(t, w.Body.String(), `{"tag":"datacenter","values":[{"value":"dc1","count":1}]}`)
+
+	w = httptest.NewRecorder()
+	body := "60\nseriesByTag('datacenter=dc1')\n"
+	server.http_list_group(w, httptest.NewRequest("POST", "/almaz/list/group/", strings.NewReader(body)))
+	AssertEqual(t, w.Code, 200)
+	AssertEqual(t, strings.HasPrefix(w.Body.String(), "seriesByTag('datacenter=dc1')\t"), true)
+	w = httptest.NewRecorder()
+	body = "60\nseriesByTag('datacenter!=dc1')\n"
+	server.http_list_group(w, httptest.NewRequest("POST", "/almaz/list/group/", strings.NewReader(body)))
+	AssertEqual(t, w.Code, 400)
+}
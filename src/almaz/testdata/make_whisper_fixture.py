@@ -0,0 +1,158 @@
+# Writes testdata/whisper/stats/shows/total.wsp with a port of whisper.py 1.1
+# create() and update_many(), trimmed to what the fixture needs:
+#   python3 testdata/make_whisper_fixture.py testdata/whisper/stats/shows/total.wsp
+import os, struct, sys
+
+longFormat = "!L"; floatFormat = "!f"
+metadataFormat = "!2LfL"; metadataSize = struct.calcsize(metadataFormat)
+archiveInfoFormat = "!3L"; archiveInfoSize = struct.calcsize(archiveInfoFormat)
+pointFormat = "!Ld"; pointSize = struct.calcsize(pointFormat)
+
+def create(path, archiveList, xFilesFactor=0.5, aggregationType=1):
+    with open(path, "wb") as fh:
+        oldest = max(s * p for s, p in archiveList)
+        fh.write(struct.pack(metadataFormat, aggregationType, oldest, xFilesFactor, len(archiveList)))
+        headerSize = metadataSize + archiveInfoSize * len(archiveList)
+        archiveOffset = headerSize
+        for s, p in archiveList:
+            fh.write(struct.pack(archiveInfoFormat, archiveOffset, s, p))
+            archiveOffset += p * pointSize
+        fh.write(b"\0" * (archiveOffset - headerSize))
+
+def info(fh):
+    fh.seek(0)
+    agg, maxRet, xff, count = struct.unpack(metadataFormat, fh.read(metadataSize))
+    archives = []
+    for i in range(count):
+        off, spp, pts = struct.unpack(archiveInfoFormat, fh.read(archiveInfoSize))
+        archives.append({"offset": off, "secondsPerPoint": spp, "points": pts,
+                         "retention": spp * pts, "size": pts * pointSize})
+    return {"aggregationType": agg, "xFilesFactor": xff, "archives": archives}
+
+def propagate(fh, header, timestamp, higher, lower):
+    xff = header["xFilesFactor"]
+    lowerIntervalStart = timestamp - (timestamp % lower["secondsPerPoint"])
+    fh.seek(higher["offset"])
+    higherBaseInterval, _ = struct.unpack(pointFormat, fh.read(pointSize))
+    if higherBaseInterval == 0:
+        higherFirstOffset = higher["offset"]
+    else:
+        pointDistance = (lowerIntervalStart - higherBaseInterval) // higher["secondsPerPoint"]
+        higherFirstOffset = higher["offset"] + ((pointDistance * pointSize) % higher["size"])
+    higherPoints = lower["secondsPerPoint"] // higher["secondsPerPoint"]
+    higherSize = higherPoints * pointSize
+    relativeFirstOffset = higherFirstOffset - higher["offset"]
+    relativeLastOffset = (relativeFirstOffset + higherSize) % higher["size"]
+    higherLastOffset = relativeLastOffset + higher["offset"]
+    fh.seek(higherFirstOffset)
+    if higherFirstOffset < higherLastOffset:
+        seriesString = fh.read(higherLastOffset - higherFirstOffset)
+    else:
+        seriesString = fh.read(higher["offset"] + higher["size"] - higherFirstOffset)
+        fh.seek(higher["offset"])
+        seriesString += fh.read(higherLastOffset - higher["offset"])
+    points = len(seriesString) // pointSize
+    unpacked = struct.unpack("!" + "Ld" * points, seriesString)
+    neighborValues = [None] * points
+    currentInterval = lowerIntervalStart
+    for i in range(0, len(unpacked), 2):
+        if unpacked[i] == currentInterval:
+            neighborValues[i // 2] = unpacked[i + 1]
+        currentInterval += higher["secondsPerPoint"]
+    knownValues = [v for v in neighborValues if v is not None]
+    if not knownValues:
+        return False
+    if float(len(knownValues)) / float(len(neighborValues)) < xff:
+        return False
+    aggregateValue = float(sum(knownValues)) / float(len(knownValues))  # average
+    myPackedPoint = struct.pack(pointFormat, lowerIntervalStart, aggregateValue)
+    fh.seek(lower["offset"])
+    lowerBaseInterval, _ = struct.unpack(pointFormat, fh.read(pointSize))
+    if lowerBaseInterval == 0:
+        fh.seek(lower["offset"])
+    else:
+        pointDistance = (lowerIntervalStart - lowerBaseInterval) // lower["secondsPerPoint"]
+        fh.seek(lower["offset"] + ((pointDistance * pointSize) % lower["size"]))
+    fh.write(myPackedPoint)
+    return True
+
+def archive_update_many(fh, header, archive, points):
+    step = archive["secondsPerPoint"]
+    alignedPoints = [(t - (t % step), v) for (t, v) in points]
+    packedStrings = []
+    previousInterval = None
+    currentString = b""
+    for i in range(len(alignedPoints)):
+        if i + 1 < len(alignedPoints) and alignedPoints[i][0] == alignedPoints[i + 1][0]:
+            continue
+        interval, value = alignedPoints[i]
+        if (not previousInterval) or (interval == previousInterval + step):
+            currentString += struct.pack(pointFormat, interval, value)
+            previousInterval = interval
+        else:
+            n = len(currentString) // pointSize
+            packedStrings.append((previousInterval - step * (n - 1), currentString))
+            currentString = struct.pack(pointFormat, interval, value)
+            previousInterval = interval
+    if currentString:
+        n = len(currentString) // pointSize
+        packedStrings.append((previousInterval - step * (n - 1), currentString))
+    fh.seek(archive["offset"])
+    baseInterval, _ = struct.unpack(pointFormat, fh.read(pointSize))
+    if baseInterval == 0:
+        baseInterval = packedStrings[0][0]
+    for interval, packedString in packedStrings:
+        pointDistance = (interval - baseInterval) // step
+        myOffset = archive["offset"] + ((pointDistance * pointSize) % archive["size"])
+        fh.seek(myOffset)
+        archiveEnd = archive["offset"] + archive["size"]
+        bytesBeyond = (myOffset + len(packedString)) - archiveEnd
+        if bytesBeyond > 0:
+            fh.write(packedString[:-bytesBeyond])
+            fh.seek(archive["offset"])
+            fh.write(packedString[-bytesBeyond:])
+        else:
+            fh.write(packedString)
+    higher = archive
+    for lower in [a for a in header["archives"] if a["secondsPerPoint"] > archive["secondsPerPoint"]]:
+        fit = lambda i: i - (i % lower["secondsPerPoint"])
+        propagateFurther = False
+        for interval in set(fit(p[0]) for p in alignedPoints):
+            if propagate(fh, header, interval, higher, lower):
+                propagateFurther = True
+        if not propagateFurther:
+            break
+        higher = lower
+
+def update_many(path, points, now):
+    points = sorted(((int(t), float(v)) for t, v in points), key=lambda p: p[0], reverse=True)
+    with open(path, "r+b") as fh:
+        header = info(fh)
+        archives = iter(header["archives"])
+        currentArchive = next(archives)
+        currentPoints = []
+        for point in points:
+            age = now - point[0]
+            while currentArchive["retention"] < age:
+                if currentPoints:
+                    currentPoints.reverse()
+                    archive_update_many(fh, header, currentArchive, currentPoints)
+                    currentPoints = []
+                currentArchive = next(archives, None)
+                if currentArchive is None:
+                    break
+            if currentArchive is None:
+                break
+            currentPoints.append(point)
+        if currentArchive and currentPoints:
+            currentPoints.reverse()
+            archive_update_many(fh, header, currentArchive, currentPoints)
+
+if __name__ == "__main__":
+    path = sys.argv[1]
+    os.makedirs(os.path.dirname(path), exist_ok=True)
+    create(path, [(10, 60), (60, 60)])  # 10s:10m,1m:1h
+    # a carbon-cache flushing every 5 minutes, for 30 minutes until 1377448200
+    start = 1377446400
+    for flush in range(start + 300, start + 1801, 300):
+        update_many(path, [(t, (t // 10) % 7 + 1) for t in range(flush - 300, flush, 10)], flush)
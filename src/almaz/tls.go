@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The Carbon listener (--address) and the http interface accept TLS when
+// --tls-cert and --tls-key are set. With --tls-client-ca clients must
+// present certificates signed by that CA, and client prefix rules limit
+// what each of them may write, by the common name of the certificate:
+//
+//   tenant-a tenants.a.
+//   tenant-b tenants.b. shared.b.
+//
+// Samples of other metrics are rejected; clients not mentioned in the
+// rules may write nothing. Without rules any client may write anything.
+
+// LoadTLSConfig makes the config of TLS listeners, or returns nil if TLS
+// is not configured.
+func LoadTLSConfig(config *Config) (*tls.Config, error) {
+	if config.TLSCert == "" && config.TLSKey == "" {
+		if config.TLSClientCA != "" {
+			return nil, fmt.Errorf("tls-client-ca requires tls-cert and tls-key")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tls_config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if config.TLSClientCA != "" {
+		pem, err := ioutil.ReadFile(config.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", config.TLSClientCA)
+		}
+		tls_config.ClientCAs = pool
+		tls_config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tls_config, nil
+}
+
+// ClientPrefixes maps common names of client certificates to prefixes
+// of metrics the clients may write.
+type ClientPrefixes map[string][]string
+
+func (self ClientPrefixes) AddRule(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return fmt.Errorf("bad client prefix rule %q, expected <common-name> <prefix> [prefix ...]", line)
+	}
+	self[fields[0]] = append(self[fields[0]], fields[1:]...)
+	return nil
+}
+
+func (self ClientPrefixes) LoadRules(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		err = self.AddRule(line)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Sender is where lines come from: a host and, for clients with
+// certificates, the prefixes of metrics it may write.
+type Sender struct {
+	Host     string
+	Name     string   // common name of the client certificate
+	prefixes []string // nil --- any metric
+}
+
+// NewSender identifies the sender of a connection; state is nil
+// for connections without TLS.
+func (self *AlmazServer) NewSender(addr string, state *tls.ConnectionState) *Sender {
+	sender := &Sender{Host: SenderHost(addr)}
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return sender
+	}
+	sender.Name = state.PeerCertificates[0].Subject.CommonName
+	if rules := self.pipeline().client_prefixes; len(rules) > 0 {
+		sender.prefixes = append(make([]string, 0), rules[sender.Name]...)
+	}
+	return sender
+}
+
+// ConnectionSender identifies the sender of a connection, after the TLS
+// handshake for TLS connections; it returns nil if the handshake fails.
+func (self *AlmazServer) ConnectionSender(conn net.Conn) *Sender {
+	tls_conn, ok := conn.(*tls.Conn)
+	if !ok {
+		return self.NewSender(conn.RemoteAddr().String(), nil)
+	}
+	err := tls_conn.Handshake()
+	if err != nil {
+		log.Printf("TLS handshake with %s failed: %s", conn.RemoteAddr(), err)
+		return nil
+	}
+	state := tls_conn.ConnectionState()
+	return self.NewSender(conn.RemoteAddr().String(), &state)
+}
+
+// unrestricted refuses requests of clients limited by client prefix
+// rules: admin and other endpoints which write beyond a prefix are
+// only for unrestricted clients.
+func (self *AlmazServer) unrestricted(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if self.NewSender(r.RemoteAddr, r.TLS).Restricted() {
+			http.Error(w, "forbidden for clients limited by client prefix rules", 403)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Restricted tells whether the sender may write only some metrics.
+func (self *Sender) Restricted() bool {
+	return self != nil && self.prefixes != nil
+}
+
+// Allows tells whether the sender may write the metric.
+func (self *Sender) Allows(metric string) bool {
+	if self == nil || self.prefixes == nil {
+		return true
+	}
+	for _, prefix := range self.prefixes {
+		if strings.HasPrefix(metric, prefix) {
+			return true
+		}
+	}
+	return false
+}
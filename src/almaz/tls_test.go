@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates signed by a self-signed CA.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	AssertEqual(t, err, nil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "almaz test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	AssertEqual(t, err, nil)
+	cert, err := x509.ParseCertificate(der)
+	AssertEqual(t, err, nil)
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns PEM-encoded certificate and key for the common name.
+func (self *testCA) issue(t *testing.T, serial int64, cn string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	AssertEqual(t, err, nil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, self.cert, &key.PublicKey, self.key)
+	AssertEqual(t, err, nil)
+	key_der, err := x509.MarshalECPrivateKey(key)
+	AssertEqual(t, err, nil)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der})
+}
+
+func (self *testCA) clientConfig(t *testing.T, cn string) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(self.pem)
+	config := &tls.Config{RootCAs: pool}
+	if cn != "" {
+		cert_pem, key_pem := self.issue(t, 3, cn)
+		cert, err := tls.X509KeyPair(cert_pem, key_pem)
+		AssertEqual(t, err, nil)
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config
+}
+
+// tlsTestServer makes a server with TLS and client prefix rules, and
+// writes the files of its TLS config to dir.
+func tlsTestServer(t *testing.T, dir string, ca *testCA) (*AlmazServer, *tls.Config) {
+	cert_pem, key_pem := ca.issue(t, 2, "almaz")
+	config := &Config{DurationInHours: 1, PrecisionInSeconds: 10,
+		TLSCert:        filepath.Join(dir, "cert.pem"),
+		TLSKey:         filepath.Join(dir, "key.pem"),
+		TLSClientCA:    filepath.Join(dir, "ca.pem"),
+		ClientPrefixes: []string{"tenant-a tenants.a.", "tenant-b tenants.b. shared.b."},
+	}
+	AssertEqual(t, ioutil.WriteFile(config.TLSCert, cert_pem, 0600), nil)
+	AssertEqual(t, ioutil.WriteFile(config.TLSKey, key_pem, 0600), nil)
+	AssertEqual(t, ioutil.WriteFile(config.TLSClientCA, ca.pem, 0600), nil)
+
+	server := NewAlmazServer()
+	AssertEqual(t, server.ApplyConfig(config), nil)
+	tls_config, err := LoadTLSConfig(config)
+	AssertEqual(t, err, nil)
+	return server, tls_config
+}
+
+func Test_ClientPrefixes(t *testing.T) {
+	prefixes := make(ClientPrefixes)
+	AssertEqual(t, prefixes.AddRule("tenant-b tenants.b. shared.b."), nil)
+	AssertEqual(t, prefixes.AddRule("tenant-b more.b."), nil)
+	AssertEqual(t, prefixes.AddRule("tenant-c") != nil, true)
+	AssertEqual(t, prefixes["tenant-b"], []string{"tenants.b.", "shared.b.", "more.b."})
+
+	sender := &Sender{Host: "10.0.0.1", Name: "tenant-b", prefixes: prefixes["tenant-b"]}
+	AssertEqual(t, sender.Allows("tenants.b.x"), true)
+	AssertEqual(t, sender.Allows("more.b.x;dc=eu"), true)
+	AssertEqual(t, sender.Allows("tenants.a.x"), false)
+	AssertEqual(t, (&Sender{Host: "10.0.0.1", prefixes: []string{}}).Allows("tenants.b.x"), false)
+	AssertEqual(t, (&Sender{Host: "10.0.0.1"}).Allows("tenants.b.x"), true)
+	AssertEqual(t, (*Sender)(nil).Allows("tenants.b.x"), true)
+}
+
+func Test_LoadTLSConfig(t *testing.T) {
+	tls_config, err := LoadTLSConfig(&Config{})
+	AssertEqual(t, tls_config == nil, true)
+	AssertEqual(t, err, nil)
+	_, err = LoadTLSConfig(&Config{TLSClientCA: "ca.pem"})
+	AssertEqual(t, err != nil, true)
+	_, err = LoadTLSConfig(&Config{TLSCert: "/nonexistent/cert.pem", TLSKey: "/nonexistent/key.pem"})
+	AssertEqual(t, err != nil, true)
+}
+
+func Test_TLSCarbon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almaz-test")
+	AssertEqual(t, err, nil)
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	server, tls_config := tlsTestServer(t, dir, ca)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	AssertEqual(t, err, nil)
+	defer listener.Close()
+	listener = tls.NewListener(listener, tls_config)
+	send := func(client_config *tls.Config, lines string) error {
+		done := make(chan bool)
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				server.handleGraphiteConnection(conn)
+			}
+			done <- true
+		}()
+		conn, err := tls.Dial("tcp", listener.Addr().String(), client_config)
+		if err == nil {
+			_, err = conn.Write([]byte(lines))
+			conn.Close()
+		}
+		<-done
+		return err
+	}
+
+	fwd, err := net.Listen("tcp", "127.0.0.1:0")
+	AssertEqual(t, err, nil)
+	defer fwd.Close()
+	config := *server.config()
+	config.FwdAddress = fwd.Addr().String()
+	config.FwdMode, config.FwdReplication = RelayModeAll, 1
+	config.FwdQueueSize, config.FwdBatchSize = 10, 10
+	AssertEqual(t, server.ApplyConfig(&config), nil)
+	forwarded := make(chan string, 10)
+	go receiveLines(fwd, forwarded)
+
+	// lines which are not samples can't be attributed to a prefix
+	err = send(ca.clientConfig(t, "tenant-a"), "tenants.a.x 1 100\ntenants.b.x 1 100\nvictim.metric 1 100 x\n")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, server.storage.HasMetric("tenants.a.x"), true)
+	AssertEqual(t, server.storage.HasMetric("tenants.b.x"), false)
+	AssertEqual(t, server.senders.Stats()["127.0.0.1"].Denied, 2)
+	expectLines(t, forwarded, "tenants.a.x 1 100")
+	select {
+	case line := <-forwarded:
+		t.Errorf("forwarded %q", line)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// certificates of unknown clients allow nothing
+	send(ca.clientConfig(t, "tenant-z"), "tenants.z.x 1 100\n")
+	AssertEqual(t, server.storage.HasMetric("tenants.z.x"), false)
+
+	// clients without certificates are refused
+	send(ca.clientConfig(t, ""), "tenants.a.y 1 100\n")
+	AssertEqual(t, server.storage.HasMetric("tenants.a.y"), false)
+	AssertEqual(t, server.storage.MetricCount(), 1)
+}
+
+func Test_TLSHttp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almaz-test")
+	AssertEqual(t, err, nil)
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	server, tls_config := tlsTestServer(t, dir, ca)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(server.http_ingest))
+	ts.TLS = tls_config
+	ts.StartTLS()
+	defer ts.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: ca.clientConfig(t, "tenant-b")}}
+	resp, err := client.Post(ts.URL+"/almaz/ingest", "text/plain", strings.NewReader("shared.b.x 1 100\ntenants.a.x 1 100\n"))
+	AssertEqual(t, err, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	AssertEqual(t, string(body), `{"accepted":1,"rejected":1,"malformed":0,"errors":[]}`)
+	AssertEqual(t, server.storage.HasMetric("shared.b.x"), true)
+	AssertEqual(t, server.storage.HasMetric("tenants.a.x"), false)
+
+	// restricted clients can't use admin endpoints
+	admin := httptest.NewUnstartedServer(server.unrestricted(server.http_restore_snapshot))
+	admin.TLS = tls_config
+	admin.StartTLS()
+	defer admin.Close()
+	resp, err = client.Post(admin.URL+"/almaz/admin/snapshots/restore/?mode=replace&name=x", "text/plain", nil)
+	AssertEqual(t, err, nil)
+	resp.Body.Close()
+	AssertEqual(t, resp.StatusCode, 403)
+	w := httptest.NewRecorder()
+	server.unrestricted(server.http_restore_snapshot)(w, httptest.NewRequest("GET", "/almaz/admin/snapshots/restore/", nil))
+	AssertEqual(t, w.Code, 405)
+
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: ca.clientConfig(t, "")}}
+	_, err = client.Post(ts.URL+"/almaz/ingest", "text/plain", strings.NewReader("shared.b.y 1 100\n"))
+	AssertEqual(t, err != nil, true)
+	AssertEqual(t, server.storage.HasMetric("shared.b.y"), false)
+}
+
+func Test_TLSInflux(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almaz-test")
+	AssertEqual(t, err, nil)
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	server, tls_config := tlsTestServer(t, dir, ca)
+	config := *server.config()
+	config.InfluxTemplate = "tenants.{tenant}.{measurement}.{field}"
+	AssertEqual(t, server.ApplyConfig(&config), nil)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	AssertEqual(t, err, nil)
+	defer listener.Close()
+	listener = tls.NewListener(listener, tls_config)
+	done := make(chan bool)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			server.handleInfluxConnection(conn)
+		}
+		done <- true
+	}()
+	conn, err := tls.Dial("tcp", listener.Addr().String(), ca.clientConfig(t, "tenant-a"))
+	AssertEqual(t, err, nil)
+	conn.Write([]byte("cpu,tenant=a value=1 100000000000\ncpu,tenant=b value=1 100000000000\n"))
+	conn.Close()
+	<-done
+	AssertEqual(t, server.storage.HasMetric("tenants.a.cpu.value"), true)
+	AssertEqual(t, server.storage.HasMetric("tenants.b.cpu.value"), false)
+	AssertEqual(t, server.senders.Stats()["127.0.0.1"].Denied, 1)
+}
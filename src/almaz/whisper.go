@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Reading and writing of Graphite's Whisper database files.
+// See http://graphite.readthedocs.org/en/latest/whisper.html for the format:
+// a metadata header, a list of archive headers and then the archives,
+// which are rings of (timestamp, value) points. All numbers are big-endian.
+
+const (
+	WhisperExtension       = ".wsp"
+	WhisperAggregationSum  = 2
+	whisperMetadataSize    = 16
+	whisperArchiveInfoSize = 12
+	whisperPointSize       = 12
+)
+
+var ErrBadWhisperFile = errors.New("bad whisper file")
+
+type WhisperArchive struct {
+	Offset          uint32
+	SecondsPerPoint uint32
+	Points          uint32
+}
+
+func (self *WhisperArchive) Retention() uint32 {
+	return self.SecondsPerPoint * self.Points
+}
+
+type WhisperPoint struct {
+	Interval uint32
+	Value    float64
+}
+
+type WhisperHeader struct {
+	AggregationType uint32
+	MaxRetention    uint32
+	XFilesFactor    float32
+	ArchiveCount    uint32
+}
+
+// WhisperPathForMetric maps a dotted metric name to Graphite's directory layout:
+// a.b.c -> <dir>/a/b/c.wsp
+func WhisperPathForMetric(dir string, name string) string {
+	return filepath.Join(dir, filepath.Join(strings.Split(name, ".")...)) + WhisperExtension
+}
+
+func MetricNameForWhisperPath(dir string, path string) (string, error) {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return "", err
+	}
+	rel = strings.TrimSuffix(rel, WhisperExtension)
+	return strings.Replace(rel, string(filepath.Separator), ".", -1), nil
+}
+
+// WriteWhisper writes the metric as a whisper file with a single archive
+// matching the metric's precision and duration.
+func (self *Metric) WriteWhisper(w io.Writer) error {
+	self.RLock()
+	defer self.RUnlock()
+
+	n := uint32(len(self.array))
+	bw := bufio.NewWriter(w)
+	header := WhisperHeader{
+		AggregationType: WhisperAggregationSum,
+		MaxRetention:    uint32(self.dt) * n,
+		XFilesFactor:    0,
+		ArchiveCount:    1,
+	}
+	archive := WhisperArchive{
+		Offset:          whisperMetadataSize + whisperArchiveInfoSize,
+		SecondsPerPoint: uint32(self.dt),
+		Points:          n,
+	}
+	if err := binary.Write(bw, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, binary.BigEndian, &archive); err != nil {
+		return err
+	}
+
+	// oldest bucket first, so that the base interval is at the start of the archive
+	oldest_k := self.latest_ts_k - int64(n) + 1
+	i := (self.latest_i + 1) % len(self.array)
+	for k := oldest_k; k <= self.latest_ts_k; k++ {
+		point := WhisperPoint{}
+		if k > 0 {
+			point.Interval = uint32(k * int64(self.dt))
+			point.Value = float64(self.array[i])
+		}
+		if err := binary.Write(bw, binary.BigEndian, &point); err != nil {
+			return err
+		}
+		i = (i + 1) % len(self.array)
+	}
+	return bw.Flush()
+}
+
+func ReadWhisper(r io.ReaderAt) (*WhisperHeader, []*WhisperArchive, error) {
+	header := &WhisperHeader{}
+	err := binary.Read(io.NewSectionReader(r, 0, whisperMetadataSize), binary.BigEndian, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header.ArchiveCount == 0 || header.ArchiveCount > 1024 {
+		return nil, nil, ErrBadWhisperFile
+	}
+	archives := make([]*WhisperArchive, header.ArchiveCount)
+	for i := range archives {
+		archives[i] = &WhisperArchive{}
+		offset := int64(whisperMetadataSize + i*whisperArchiveInfoSize)
+		err = binary.Read(io.NewSectionReader(r, offset, whisperArchiveInfoSize), binary.BigEndian, archives[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		if archives[i].SecondsPerPoint == 0 {
+			return nil, nil, ErrBadWhisperFile
+		}
+	}
+	return header, archives, nil
+}
+
+func ReadWhisperArchive(r io.ReaderAt, archive *WhisperArchive) ([]WhisperPoint, error) {
+	points := make([]WhisperPoint, archive.Points)
+	section := io.NewSectionReader(r, int64(archive.Offset), int64(archive.Points)*whisperPointSize)
+	err := binary.Read(bufio.NewReader(section), binary.BigEndian, points)
+	if err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// ReadWhisperPoints returns points of all archives which are valid at `now`,
+// oldest first. Where archives overlap, the most precise one is used.
+func ReadWhisperPoints(r io.ReaderAt, now int64) ([]WhisperPoint, error) {
+	_, archives, err := ReadWhisper(r)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].SecondsPerPoint < archives[j].SecondsPerPoint
+	})
+
+	result := make([]WhisperPoint, 0)
+	covered_from := now + 1
+	for _, archive := range archives {
+		points, err := ReadWhisperArchive(r, archive)
+		if err != nil {
+			return nil, err
+		}
+		valid_from := now - int64(archive.Retention())
+		for _, point := range points {
+			ts := int64(point.Interval)
+			if point.Interval == 0 || ts <= valid_from || ts >= covered_from {
+				continue
+			}
+			if math.IsNaN(point.Value) {
+				continue
+			}
+			result = append(result, point)
+		}
+		if valid_from < covered_from {
+			covered_from = valid_from + 1
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Interval < result[j].Interval
+	})
+	return result, nil
+}
+
+func (self *Storage) ExportWhisper(dir string) error {
+	for name, metric := range self.Metrics() {
+		path := WhisperPathForMetric(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		err = metric.WriteWhisper(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// ImportWhisper adds data from every whisper file under dir to the storage.
+// Values are taken as they are, i.e. each point adds to the almaz bucket it falls into.
+func (self *Storage) ImportWhisper(dir string, now int64) (int, error) {
+	imported := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, WhisperExtension) {
+			return nil
+		}
+		name, err := MetricNameForWhisperPath(dir, path)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		points, err := ReadWhisperPoints(file, now)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		for _, point := range points {
+			if point.Value != 0 {
+				self.StoreMetric(name, point.Value, int64(point.Interval))
+			}
+		}
+		imported++
+		return nil
+	})
+	return imported, err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type whisperFixtureArchive struct {
+	secondsPerPoint uint32
+	points          uint32
+	data            []WhisperPoint // in ring order, starting from slot 0
+}
+
+// writeWhisperFixture lays out a whisper file the way whisper.py does.
+func writeWhisperFixture(t *testing.T, path string, archives []whisperFixtureArchive) {
+	AssertEqual(t, os.MkdirAll(filepath.Dir(path), 0755), nil)
+	file, err := os.Create(path)
+	AssertEqual(t, err, nil)
+	defer file.Close()
+
+	max_retention := uint32(0)
+	for _, a := range archives {
+		if a.secondsPerPoint*a.points > max_retention {
+			max_retention = a.secondsPerPoint * a.points
+		}
+	}
+	be := binary.BigEndian
+	binary.Write(file, be, []uint32{1, max_retention})
+	binary.Write(file, be, float32(0.5))
+	binary.Write(file, be, uint32(len(archives)))
+	offset := uint32(16 + 12*len(archives))
+	for _, a := range archives {
+		binary.Write(file, be, []uint32{offset, a.secondsPerPoint, a.points})
+		offset += 12 * a.points
+	}
+	for _, a := range archives {
+		for i := uint32(0); i < a.points; i++ {
+			point := WhisperPoint{}
+			if int(i) < len(a.data) {
+				point = a.data[i]
+			}
+			binary.Write(file, be, point.Interval)
+			binary.Write(file, be, point.Value)
+		}
+	}
+}
+
+func Test_WhisperImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almaz-test")
+	AssertEqual(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	writeWhisperFixture(t, filepath.Join(dir, "stats", "shows", "total.wsp"), []whisperFixtureArchive{
+		{10, 6, []WhisperPoint{
+			{980, 4}, {990, 5}, {1000, 6},
+			{890, 100}, // stale: older than the archive retention
+			{960, 2}, {970, 3},
+		}},
+		{60, 10, []WhisperPoint{
+			{420, 10}, {480, 10}, {540, 10}, {600, 10}, {660, 10},
+			{720, 10}, {780, 10}, {840, 10}, {900, 10},
+			{960, 10}, // covered by the precise archive
+		}},
+	})
+	writeWhisperFixture(t, filepath.Join(dir, "empty.wsp"), []whisperFixtureArchive{
+		{10, 6, nil},
+	})
+	ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a whisper file"), 0644)
+
+	s := NewStorage()
+	s.SetStorageParams(1, 10)
+	n, err := s.ImportWhisper(dir, 1000)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, n, 2)
+	AssertEqual(t, s.MetricCount(), 1)
+
+	m := s.metrics["stats.shows.total"]
+	AssertEqual(t, m.splitName, []string{"stats", "shows", "total"})
+	AssertEqual(t, m.GetSumBetween(0, 2000), 20+90)
+	AssertEqual(t, m.GetValueAt(900), 10)
+	AssertEqual(t, m.GetValueAt(960), 2)
+	AssertEqual(t, m.GetValueAt(1000), 6)
+}
+
+// testdata/whisper/stats/shows/total.wsp is written by whisper.py's create
+// (10s:10m,1m:1h, average, xFilesFactor 0.5) and update_many, ported in
+// testdata/make_whisper_fixture.py, as a carbon-cache flushing every
+// 5 minutes would write it, unlike writeWhisperFixture: points every
+// 10 seconds with values (ts / 10) % 7 + 1, from 1377446400 to 1377448190.
+// The precise archive has wrapped around, the coarse one holds averages.
+func Test_WhisperImportFixture(t *testing.T) {
+	s := NewStorage()
+	s.SetStorageParams(1, 10)
+	n, err := s.ImportWhisper(filepath.Join("testdata", "whisper"), 1377448200)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, n, 1)
+
+	m := s.metrics["stats.shows.total"]
+	AssertEqual(t, m.GetValueAt(1377448190), 3)
+	AssertEqual(t, m.GetValueAt(1377447610), 1)
+	// older points come from the coarse archive, one per minute
+	AssertEqual(t, m.GetValueAt(1377447600), float64(float32(22.0/6)))
+	AssertEqual(t, m.GetValueAt(1377447590), 0)
+	AssertEqual(t, m.GetValueAt(1377446400), float64(float32(23.0/6)))
+	AssertEqual(t, math.Round(m.GetSumBetween(1377446400, 1377448200)), 314)
+}
+
+func Test_WhisperImportBadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almaz-test")
+	AssertEqual(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "bad.wsp"), []byte("garbage"), 0644)
+	s := NewStorage()
+	_, err = s.ImportWhisper(dir, 1000)
+	AssertEqual(t, err != nil, true)
+}
+
+func Test_WhisperExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almaz-test")
+	AssertEqual(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	s := NewStorage()
+	s.SetStorageParams(1, 10)
+	s.StoreMetric("a.b.c", 10, 1000)
+	s.StoreMetric("a.b.c", 12, 1020)
+	s.StoreMetric("a.b.c", 3, 4590)
+	s.StoreMetric("a.d", 7, 4000)
+	AssertEqual(t, s.ExportWhisper(dir), nil)
+
+	file, err := os.Open(filepath.Join(dir, "a", "b", "c.wsp"))
+	AssertEqual(t, err, nil)
+	defer file.Close()
+	header, archives, err := ReadWhisper(file)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, header.AggregationType, WhisperAggregationSum)
+	AssertEqual(t, header.MaxRetention, 3600)
+	AssertEqual(t, len(archives), 1)
+	AssertEqual(t, archives[0].SecondsPerPoint, 10)
+	AssertEqual(t, archives[0].Points, 360)
+
+	imported := NewStorage()
+	imported.SetStorageParams(1, 10)
+	n, err := imported.ImportWhisper(dir, 4590)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, n, 2)
+	AssertEqual(t, imported.metrics["a.b.c"].GetSumBetween(0, 5000), 10+12+3)
+	AssertEqual(t, imported.metrics["a.b.c"].GetValueAt(4590), 3)
+	AssertEqual(t, imported.metrics["a.d"].GetValueAt(4000), 7)
+}